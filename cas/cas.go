@@ -26,6 +26,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -41,6 +42,10 @@ import (
 const (
 	blobType int64 = iota
 	imageManifestType
+	tocType
+	checkpointType
+	checkpointInfoType
+	rawBlobType
 
 	defaultPathPerm os.FileMode = 0777
 	defaultFilePerm os.FileMode = 0660
@@ -57,16 +62,21 @@ const (
 var diskvStores = [...]string{
 	"blob",
 	"imageManifest",
+	"toc",
+	"checkpoint",
+	"checkpointInfo",
+	"rawBlob",
 }
 
 // Store encapsulates a content-addressable-storage for storing ACIs on disk.
 type Store struct {
-	base             string
-	stores           []*diskv.Diskv
-	db               *DB
-	treestore        *TreeStore
-	imageLockDir     string
-	treeStoreLockDir string
+	base              string
+	stores            []*diskv.Diskv
+	db                *DB
+	treestore         *TreeStore
+	imageLockDir      string
+	treeStoreLockDir  string
+	checkpointLockDir string
 }
 
 func NewStore(base string) (*Store, error) {
@@ -89,6 +99,12 @@ func NewStore(base string) (*Store, error) {
 		return nil, err
 	}
 
+	ds.checkpointLockDir = filepath.Join(casDir, "checkpointlocks")
+	err = os.MkdirAll(ds.checkpointLockDir, defaultPathPerm)
+	if err != nil {
+		return nil, err
+	}
+
 	for i, p := range diskvStores {
 		ds.stores[i] = diskv.New(diskv.Options{
 			BasePath:  filepath.Join(casDir, p),
@@ -207,12 +223,35 @@ func (ds Store) ReadStream(key string) (io.ReadCloser, error) {
 	return ds.stores[blobType].ReadStream(key, false)
 }
 
+// ReadRawStream returns the as-fetched bytes of the ACI identified by key,
+// before WriteACI's decompression -- i.e. whatever a detached signature for
+// this image was actually computed over. Use this instead of ReadStream
+// when checking a signature.
+func (ds Store) ReadRawStream(key string) (io.ReadCloser, error) {
+	key, err := ds.ResolveKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving key: %v", err)
+	}
+	keyLock, err := lock.SharedKeyLock(ds.imageLockDir, key)
+	if err != nil {
+		return nil, fmt.Errorf("error locking image: %v", err)
+	}
+	defer keyLock.Close()
+
+	return ds.stores[rawBlobType].ReadStream(key, false)
+}
+
 // WriteACI takes an ACI encapsulated in an io.Reader, decompresses it if
 // necessary, and then stores it in the store under a key based on the image ID
 // (i.e. the hash of the uncompressed ACI)
 // latest defines if the aci has to be marked as the latest. For example an ACI
 // discovered without asking for a specific version (latest pattern).
 func (ds Store) WriteACI(r io.Reader, latest bool) (string, error) {
+	// If the original reader can seek, the source is cheap to re-scan (a
+	// local file, or an HTTP Remote fetched with Range support), so it's
+	// worth building a TOC for lazy, on-demand rendering later on.
+	_, lazyEligible := r.(io.ReadSeeker)
+
 	// Peek at the first 512 bytes of the reader to detect filetype
 	br := bufio.NewReaderSize(r, 32768)
 	hd, err := br.Peek(512)
@@ -226,7 +265,16 @@ func (ds Store) WriteACI(r io.Reader, latest bool) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("error detecting image type: %v", err)
 	}
-	dr, err := decompress(br, typ)
+
+	// Tee the as-fetched bytes (still compressed, if the source was) to a
+	// temporary file as we read through br. A detached signature is
+	// computed over these original bytes, not our normalized decompressed
+	// copy, so verifyImageSignature needs this raw copy to check against.
+	rawFh, err := ds.TmpFile()
+	if err != nil {
+		return "", fmt.Errorf("error creating image: %v", err)
+	}
+	dr, err := decompress(io.TeeReader(br, rawFh), typ)
 	if err != nil {
 		return "", fmt.Errorf("error decompressing image: %v", err)
 	}
@@ -258,10 +306,25 @@ func (ds Store) WriteACI(r io.Reader, latest bool) (string, error) {
 	}
 	defer keyLock.Close()
 
+	isLazy := false
+	if lazyEligible {
+		if err := ds.writeTOC(fh.Name(), key); err != nil {
+			return "", fmt.Errorf("error building lazy TOC: %v", err)
+		}
+		isLazy = true
+	}
+
 	if err = ds.stores[blobType].Import(fh.Name(), key, true); err != nil {
 		return "", fmt.Errorf("error importing image: %v", err)
 	}
 
+	if err := rawFh.Close(); err != nil {
+		return "", fmt.Errorf("error closing image: %v", err)
+	}
+	if err = ds.stores[rawBlobType].Import(rawFh.Name(), key, true); err != nil {
+		return "", fmt.Errorf("error importing raw image: %v", err)
+	}
+
 	// Save the imagemanifest using the same key used for the image
 	imj, err := json.Marshal(im)
 	if err != nil {
@@ -278,6 +341,7 @@ func (ds Store) WriteACI(r io.Reader, latest bool) (string, error) {
 			AppName:    im.Name.String(),
 			ImportTime: time.Now(),
 			Latest:     latest,
+			LazyBlob:   isLazy,
 		}
 		return WriteACIInfo(tx, aciinfo)
 	}); err != nil {
@@ -295,19 +359,29 @@ func (ds Store) WriteACI(r io.Reader, latest bool) (string, error) {
 // already fully rendered.
 // Users of treestore should call ds.RenderTreeStore before using it to ensure
 // that the treestore is completely rendered.
-func (ds Store) RenderTreeStore(key string, rebuild bool) error {
+// When lazy is true and the blob has a TOC (see WriteACI), nothing is
+// extracted to disk: directories and symlinks are served from the TOC and
+// regular file contents on demand through a FUSE mount over the rootfs,
+// fetched and verified chunk-by-chunk against the TOC.
+// When fileMap is non-nil, only the paths it names (plus their parent
+// directories) are extracted, for a slim rootfs subset; the filtered
+// render is cached under its own key (see TreeStoreKey) so it can't
+// collide with a full render of the same image.
+func (ds Store) RenderTreeStore(key string, rebuild bool, lazy bool, fileMap map[string]struct{}) error {
+	tsKey := TreeStoreKey(key, fileMap)
+
 	// this lock references the treestore dir for the specified key. This
 	// is different from a lock on an image key as internally
 	// treestore.Write calls the acirenderer functions that use GetACI and
 	// GetImageManifest which are taking the image(s) lock.
-	treeStoreKeyLock, err := lock.ExclusiveKeyLock(ds.treeStoreLockDir, key)
+	treeStoreKeyLock, err := lock.ExclusiveKeyLock(ds.treeStoreLockDir, tsKey)
 	if err != nil {
 		return fmt.Errorf("error locking tree store: %v", err)
 	}
 	defer treeStoreKeyLock.Close()
 
 	if !rebuild {
-		rendered, err := ds.treestore.IsRendered(key)
+		rendered, err := ds.treestore.IsRendered(tsKey)
 		if err != nil {
 			return fmt.Errorf("cannot determine if tree is already rendered: %v", err)
 		}
@@ -318,41 +392,98 @@ func (ds Store) RenderTreeStore(key string, rebuild bool) error {
 	// Firstly remove a possible partial treestore if existing.
 	// This is needed as a previous ACI removal operation could have failed
 	// cleaning the tree store leaving some stale files.
-	err = ds.treestore.Remove(key)
+	err = ds.treestore.Remove(tsKey)
 	if err != nil {
 		return err
 	}
-	err = ds.treestore.Write(key, &ds)
+
+	if lazy {
+		if _, ok, err := ds.getTOC(key); err != nil {
+			return fmt.Errorf("error checking for lazy TOC: %v", err)
+		} else if !ok {
+			return fmt.Errorf("cannot render %q lazily: no TOC recorded for this blob", key)
+		}
+		return ds.treestore.WriteLazy(tsKey, key, &ds, fileMap)
+	}
+
+	err = ds.treestore.Write(tsKey, key, &ds, fileMap)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// CheckTreeStore verifies the treestore consistency for the specified key.
-func (ds Store) CheckTreeStore(key string) error {
-	treeStoreKeyLock, err := lock.SharedKeyLock(ds.treeStoreLockDir, key)
+// CheckTreeStore verifies the treestore consistency for the specified key
+// and fileMap combination.
+// For any image whose blob has a TOC, this also checks that the rootfs can
+// still be stat'ed as a directory (a dead FUSE mount fails here) and that
+// the recorded TOC has entries; TOC digests are not re-verified here.
+func (ds Store) CheckTreeStore(key string, fileMap map[string]struct{}) error {
+	tsKey := TreeStoreKey(key, fileMap)
+
+	treeStoreKeyLock, err := lock.SharedKeyLock(ds.treeStoreLockDir, tsKey)
 	if err != nil {
 		return fmt.Errorf("error locking tree store: %v", err)
 	}
 	defer treeStoreKeyLock.Close()
 
-	return ds.treestore.Check(key)
+	if err := ds.treestore.Check(tsKey); err != nil {
+		return err
+	}
+
+	if toc, ok, err := ds.getTOC(key); err != nil {
+		return fmt.Errorf("error reading lazy TOC: %v", err)
+	} else if ok {
+		if err := checkLazyMount(ds.treestore.GetRootFS(tsKey), toc); err != nil {
+			return fmt.Errorf("lazy treestore is inconsistent: %v", err)
+		}
+	}
+
+	return nil
 }
 
-// GetTreeStorePath returns the absolute path of the treestore for the specified key.
+// GetTreeStorePath returns the absolute path of the treestore for the
+// specified key and fileMap combination.
 // It doesn't ensure that the path exists and is fully rendered. This should
 // be done calling IsRendered()
-func (ds Store) GetTreeStorePath(key string) string {
-	return ds.treestore.GetPath(key)
+func (ds Store) GetTreeStorePath(key string, fileMap map[string]struct{}) string {
+	return ds.treestore.GetPath(TreeStoreKey(key, fileMap))
 }
 
 // GetTreeStoreRootFS returns the absolute path of the rootfs in the treestore
-// for specified key.
+// for the specified key and fileMap combination.
 // It doesn't ensure that the rootfs exists and is fully rendered. This should
 // be done calling IsRendered()
-func (ds Store) GetTreeStoreRootFS(key string) string {
-	return ds.treestore.GetRootFS(key)
+func (ds Store) GetTreeStoreRootFS(key string, fileMap map[string]struct{}) string {
+	return ds.treestore.GetRootFS(TreeStoreKey(key, fileMap))
+}
+
+// TreeStoreKey returns the cache key under which an image's treestore is
+// kept. A nil or empty fileMap renders the same key as before (a plain
+// render of the whole image); otherwise the key is salted with a hash of
+// fileMap's sorted paths so a filtered render and a full render of the
+// same image are cached independently rather than overwriting each other.
+// It's exported so callers building a GC used-keys set (e.g. stage0.Prepare)
+// can compute the same salted key the treestore was actually rendered
+// under for an app with a PerAppFileMap entry.
+func TreeStoreKey(key string, fileMap map[string]struct{}) string {
+	if len(fileMap) == 0 {
+		return key
+	}
+
+	paths := make([]string, 0, len(fileMap))
+	for p := range fileMap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	h := sha512.New()
+	for _, p := range paths {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%s-fm-%x", key, h.Sum(nil)[:8])
 }
 
 // GetRemote tries to retrieve a remote with the given ACIURL. found will be
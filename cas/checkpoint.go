@@ -0,0 +1,109 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coreos/rkt/pkg/lock"
+)
+
+// CheckpointInfo records the metadata associated with a single pod
+// checkpoint blob, so multiple checkpoints of the same pod can be listed and
+// related to one another without re-reading the (potentially large)
+// checkpoint image itself.
+type CheckpointInfo struct {
+	PodID     string
+	BlobKey   string
+	Timestamp time.Time
+	ParentKey string // key of the checkpoint this one was taken relative to, if any
+	Metadata  map[string]string
+}
+
+// WriteCheckpoint stores a pod checkpoint image (as produced by
+// Networking.Checkpoint plus a CRIU dump) in the content-addressed
+// checkpoint store, keyed by the sha512 of its contents exactly like a blob,
+// so repeated checkpoints of an unchanged pod dedupe for free.
+func (ds Store) WriteCheckpoint(podID string, r io.Reader, meta map[string]string) (string, error) {
+	h := sha512.New()
+	tr := io.TeeReader(r, h)
+
+	fh, err := ds.TmpFile()
+	if err != nil {
+		return "", fmt.Errorf("error creating checkpoint: %v", err)
+	}
+	if _, err := io.Copy(fh, tr); err != nil {
+		fh.Close()
+		return "", fmt.Errorf("error copying checkpoint: %v", err)
+	}
+	if err := fh.Close(); err != nil {
+		return "", fmt.Errorf("error closing checkpoint: %v", err)
+	}
+
+	key := ds.HashToKey(h)
+	keyLock, err := lock.ExclusiveKeyLock(ds.checkpointLockDir, key)
+	if err != nil {
+		return "", fmt.Errorf("error locking checkpoint: %v", err)
+	}
+	defer keyLock.Close()
+
+	if err := ds.stores[checkpointType].Import(fh.Name(), key, true); err != nil {
+		return "", fmt.Errorf("error importing checkpoint: %v", err)
+	}
+
+	info := &CheckpointInfo{
+		PodID:     podID,
+		BlobKey:   key,
+		Timestamp: time.Now(),
+		Metadata:  meta,
+	}
+	infoj, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling checkpoint info: %v", err)
+	}
+	if err := ds.stores[checkpointInfoType].Write(key, infoj); err != nil {
+		return "", fmt.Errorf("error writing checkpoint info: %v", err)
+	}
+
+	return key, nil
+}
+
+// OpenCheckpoint returns a reader for the checkpoint image stored under key.
+func (ds Store) OpenCheckpoint(key string) (io.ReadCloser, error) {
+	keyLock, err := lock.SharedKeyLock(ds.checkpointLockDir, key)
+	if err != nil {
+		return nil, fmt.Errorf("error locking checkpoint: %v", err)
+	}
+	defer keyLock.Close()
+
+	return ds.stores[checkpointType].ReadStream(key, false)
+}
+
+// GetCheckpointInfo retrieves the metadata recorded for a checkpoint key.
+func (ds Store) GetCheckpointInfo(key string) (*CheckpointInfo, error) {
+	infoj, err := ds.stores[checkpointInfoType].Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving checkpoint info: %v", err)
+	}
+	info := &CheckpointInfo{}
+	if err := json.Unmarshal(infoj, info); err != nil {
+		return nil, fmt.Errorf("error unmarshalling checkpoint info: %v", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema"
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+
+	"github.com/coreos/rkt/cas/transports"
+)
+
+// CopyFrom pulls an image through an external transport (a Docker registry,
+// an OCI image layout, or a plain directory) and converts it on the fly
+// into an ACI. Multi-layer images get one dependency ACI per layer, named
+// and pinned by the layer's content hash, so the treestore can share
+// layers across images exactly as it shares any other ACI dependency; the
+// final, returned key is the top-level ACI whose App and Dependencies tie
+// the layers together.
+func (ds Store) CopyFrom(ref transports.Reference) (string, error) {
+	// aci:// is already in ACI form; skip the layer-conversion path.
+	if o, ok := ref.(interface {
+		Open() (io.ReadCloser, error)
+	}); ok {
+		r, err := o.Open()
+		if err != nil {
+			return "", fmt.Errorf("error opening %q: %v", ref.String(), err)
+		}
+		defer r.Close()
+
+		key, err := ds.WriteACI(r, true)
+		if err != nil {
+			return "", err
+		}
+		return key, ds.recordTransportRemote(ref, key)
+	}
+
+	layers, err := ref.Layers()
+	if err != nil {
+		return "", fmt.Errorf("error listing layers for %q: %v", ref.String(), err)
+	}
+	cfg, err := ref.Config()
+	if err != nil {
+		return "", fmt.Errorf("error reading image config for %q: %v", ref.String(), err)
+	}
+
+	deps := make(types.Dependencies, 0, len(layers))
+	for _, l := range layers {
+		key, err := ds.copyLayer(l)
+		if err != nil {
+			return "", fmt.Errorf("error converting layer %s: %v", l.Digest, err)
+		}
+		h, err := types.NewHash(key)
+		if err != nil {
+			return "", fmt.Errorf("error hashing layer key %q: %v", key, err)
+		}
+		deps = append(deps, types.Dependency{
+			ImageName: layerName(l.Digest),
+			ImageID:   h,
+		})
+	}
+
+	im, err := synthesizeManifest(ref.String(), cfg, deps)
+	if err != nil {
+		return "", err
+	}
+
+	tarFile, err := ds.buildACITar(im, nil)
+	if err != nil {
+		return "", fmt.Errorf("error building converted ACI: %v", err)
+	}
+	defer tarFile.Close()
+
+	key, err := ds.WriteACI(tarFile, true)
+	if err != nil {
+		return "", err
+	}
+	return key, ds.recordTransportRemote(ref, key)
+}
+
+// copyLayer converts a single transport layer into a standalone dependency
+// ACI (no App section, just a rootfs/) and stores it under the normal blob
+// path, returning its key.
+func (ds Store) copyLayer(l transports.Layer) (string, error) {
+	r, err := l.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	im := &schema.ImageManifest{
+		ACKind:    schema.ImageManifestKind,
+		ACVersion: *schema.AppContainerVersion,
+		Name:      layerName(l.Digest),
+	}
+
+	tarFile, err := ds.buildACITar(im, r)
+	if err != nil {
+		return "", err
+	}
+	defer tarFile.Close()
+
+	return ds.WriteACI(tarFile, false)
+}
+
+// layerName derives a stable ACName for a layer's dependency ACI from its
+// transport digest (e.g. "sha256:abcd..." -> "layer-sha256-abcd...").
+func layerName(digest string) types.ACName {
+	sanitized := strings.Replace(digest, ":", "-", -1)
+	n, err := types.NewACName("layer-" + sanitized)
+	if err != nil {
+		// digests are lowercase hex plus a colon we already replaced, so
+		// this is always a valid ACName.
+		panic(err)
+	}
+	return *n
+}
+
+// synthesizeManifest builds the top-level ImageManifest for a converted
+// image: an App derived from the source transport's runtime config, and a
+// Dependencies list referencing each layer ACI by content hash so the
+// treestore assembles them in order.
+func synthesizeManifest(ref string, cfg *transports.ImageConfig, deps types.Dependencies) (*schema.ImageManifest, error) {
+	n, err := types.NewACName(sanitizeImageName(ref))
+	if err != nil {
+		return nil, fmt.Errorf("error deriving ACName from %q: %v", ref, err)
+	}
+
+	env := types.Environment{}
+	for _, kv := range cfg.Env {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) == 2 {
+			env.Set(pair[0], pair[1])
+		}
+	}
+
+	app := &types.App{
+		Exec:             cfg.Exec,
+		User:             "0",
+		Group:            "0",
+		WorkingDirectory: cfg.WorkingDir,
+		Environment:      env,
+	}
+
+	return &schema.ImageManifest{
+		ACKind:       schema.ImageManifestKind,
+		ACVersion:    *schema.AppContainerVersion,
+		Name:         *n,
+		App:          app,
+		Dependencies: deps,
+	}, nil
+}
+
+// sanitizeImageName turns a transport reference like
+// "docker://registry-1.docker.io/library/alpine:latest" into a string
+// that's a valid ACName: lowercase, with anything that isn't
+// alphanumeric, '-', '_', '/' or '.' collapsed to a single '-'.
+func sanitizeImageName(ref string) string {
+	if i := strings.Index(ref, "://"); i >= 0 {
+		ref = ref[i+len("://"):]
+	}
+	var b strings.Builder
+	lastDash := false
+	for _, c := range strings.ToLower(ref) {
+		valid := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '/' || c == '.'
+		if valid {
+			b.WriteRune(c)
+			lastDash = false
+		} else if !lastDash {
+			b.WriteRune('-')
+			lastDash = true
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// buildACITar assembles an ACI archive on disk: the manifest file plus, if
+// rootfs is non-nil, its tar entries re-rooted under "rootfs/". When rootfs
+// is nil, an empty "rootfs/" directory entry is written instead, for
+// manifest-only ACIs whose content comes entirely from their Dependencies.
+func (ds Store) buildACITar(im *schema.ImageManifest, rootfs io.Reader) (*os.File, error) {
+	fh, err := ds.TmpFile()
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(fh.Name()) // unlink now, the open fd keeps it alive until Close
+	tw := tar.NewWriter(fh)
+
+	imj, err := json.Marshal(im)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(imj))}); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if _, err := tw.Write(imj); err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	if rootfs == nil {
+		if err := tw.WriteHeader(&tar.Header{Name: "rootfs/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+			fh.Close()
+			return nil, err
+		}
+	} else {
+		tr := tar.NewReader(rootfs)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fh.Close()
+				return nil, err
+			}
+			hdr.Name = path.Join("rootfs", hdr.Name)
+			if err := tw.WriteHeader(hdr); err != nil {
+				fh.Close()
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(tw, tr); err != nil {
+					fh.Close()
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return fh, nil
+}
+
+// recordTransportRemote saves a Remote for a transport-fetched image so a
+// later re-fetch knows to go back through the same transport rather than
+// assuming a plain ACI URL.
+func (ds Store) recordTransportRemote(ref transports.Reference, key string) error {
+	return ds.WriteRemote(&Remote{
+		ACIURL:       ref.String(),
+		BlobKey:      key,
+		TransportRef: ref.String(),
+		DownloadTime: time.Now(),
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Dependencies returns the blob keys of every image that key transitively
+// depends on (not including key itself), resolving each schema.Dependency
+// by ImageID when pinned or by ImageName/Labels via GetACI otherwise. The
+// result is ordered innermost-first (a dependency always comes after
+// anything it in turn depends on), matching the order acirenderer stacks
+// layers in and the order CreateDepListFromImageID hands to stage0 for
+// building a multi-layer overlay lowerdir. It's used to walk a pod's full
+// image set -- not just its top-level apps -- for operations like
+// signature verification that must cover everything that will actually
+// end up in the rendered rootfs.
+func (ds Store) Dependencies(key string) ([]string, error) {
+	seen := map[string]bool{}
+	var deps []string
+
+	var walk func(k string) error
+	walk = func(k string) error {
+		im, err := ds.GetImageManifest(k)
+		if err != nil {
+			return fmt.Errorf("error getting manifest for %q: %v", k, err)
+		}
+
+		for _, dep := range im.Dependencies {
+			var depKey string
+			if dep.ImageID != nil {
+				depKey, err = ds.ResolveKey(dep.ImageID.String())
+			} else {
+				depKey, err = ds.GetACI(dep.ImageName, dep.Labels)
+			}
+			if err != nil {
+				return fmt.Errorf("error resolving dependency %q: %v", dep.ImageName, err)
+			}
+
+			if seen[depKey] {
+				continue
+			}
+			seen[depKey] = true
+			if err := walk(depKey); err != nil {
+				return err
+			}
+			deps = append(deps, depKey)
+		}
+		return nil
+	}
+
+	if err := walk(key); err != nil {
+		return nil, err
+	}
+
+	return deps, nil
+}
+
+// GetRemoteByBlobKey looks up the Remote a blob was fetched through, if
+// any, so callers can verify its signature or re-fetch it via the same
+// transport it originally came from.
+func (ds Store) GetRemoteByBlobKey(key string) (*Remote, bool, error) {
+	var remote *Remote
+	found := false
+	err := ds.db.Do(func(tx *sql.Tx) error {
+		var err error
+		remote, found, err = GetRemoteByBlobKey(tx, key)
+		return err
+	})
+	return remote, found, err
+}
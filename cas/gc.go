@@ -0,0 +1,62 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/rkt/pkg/lock"
+)
+
+// GC removes every treestore entry not named in usedKeys. Callers (stage0,
+// after a successful Prepare) pass in the full set of images and
+// dependencies actually wired into every pod still on disk, so anything
+// left over is safe to prune; this is what keeps the treestore from
+// growing without bound as images are replaced across pods.
+func (ds Store) GC(usedKeys []string) error {
+	used := make(map[string]bool, len(usedKeys))
+	for _, k := range usedKeys {
+		used[k] = true
+	}
+
+	keys, err := ds.treestore.GetAllKeys()
+	if err != nil {
+		return fmt.Errorf("error listing tree store: %v", err)
+	}
+
+	var errs []string
+	for _, key := range keys {
+		if used[key] {
+			continue
+		}
+
+		treeStoreKeyLock, err := lock.ExclusiveKeyLock(ds.treeStoreLockDir, key)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: error locking tree store: %v", key, err))
+			continue
+		}
+		err = ds.treestore.Remove(key)
+		treeStoreKeyLock.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error garbage collecting tree store:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
@@ -0,0 +1,514 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cas
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/bazil.org/fuse"
+	fusefs "github.com/coreos/rkt/Godeps/_workspace/src/bazil.org/fuse/fs"
+	"github.com/coreos/rkt/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// chunkSize is the size lazily-rendered files are split into; each chunk is
+// fetched and verified independently so a single bad range doesn't require
+// re-downloading the whole file.
+const chunkSize = 4 * 1024 * 1024 // 4 MiB
+
+// tocChunk describes one ~chunkSize slice of a file's data.
+type tocChunk struct {
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"` // sha256 of the chunk's bytes
+}
+
+// tocEntry describes one entry (file, directory or symlink) recorded in a
+// blob's TOC. Only regular files carry Digest/Chunks; directories and
+// symlinks just need enough metadata to be recreated without re-reading the
+// tar.
+type tocEntry struct {
+	Name       string      `json:"name"` // tar entry name within the ACI, e.g. "rootfs/usr/bin/app"
+	Typeflag   byte        `json:"typeflag"`
+	Mode       os.FileMode `json:"mode"`
+	UID        int         `json:"uid"`
+	GID        int         `json:"gid"`
+	LinkTarget string      `json:"linkTarget,omitempty"` // symlinks only
+
+	Size   int64      `json:"size,omitempty"`
+	Offset int64      `json:"offset,omitempty"` // byte offset of the file's data within the uncompressed tar
+	Digest string     `json:"digest,omitempty"` // sha256 of the whole file
+	Chunks []tocChunk `json:"chunks,omitempty"`
+}
+
+func (e *tocEntry) isRegular() bool { return e.Typeflag == tar.TypeReg || e.Typeflag == tar.TypeRegA }
+
+// toc is the table of contents persisted alongside a lazily-imported blob.
+// It records the full tree (directories, symlinks and chunked file digests)
+// so TreeStore.WriteLazy can reconstruct the rootfs without re-reading the
+// tar, serving file data on demand instead.
+type toc struct {
+	Entries []tocEntry `json:"entries"`
+}
+
+// writeTOC scans the uncompressed tar at tarPath, recording every entry's
+// metadata and, for regular files, chunk digests, then persists the result
+// to the toc diskv store under key.
+func (ds Store) writeTOC(tarPath string, key string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t, err := buildTOC(f)
+	if err != nil {
+		return err
+	}
+
+	tocj, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("error marshalling TOC: %v", err)
+	}
+	return ds.stores[tocType].Write(key, tocj)
+}
+
+// buildTOC walks the tar in r, recording every entry and, for regular
+// files, the offset and per-chunk digests of its data.
+func buildTOC(r io.Reader) (*toc, error) {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	t := &toc{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading tar entry: %v", err)
+		}
+
+		entry := tocEntry{
+			Name:       hdr.Name,
+			Typeflag:   hdr.Typeflag,
+			Mode:       os.FileMode(hdr.Mode),
+			UID:        hdr.Uid,
+			GID:        hdr.Gid,
+			LinkTarget: hdr.Linkname,
+			Size:       hdr.Size,
+		}
+
+		if entry.isRegular() {
+			// cr.n is the absolute offset of this entry's first data byte:
+			// tr.Next() has just consumed the header(s) and nothing else.
+			entry.Offset = cr.n
+			digest, chunks, err := digestTarEntry(tr, hdr.Size)
+			if err != nil {
+				return nil, fmt.Errorf("error digesting %q: %v", hdr.Name, err)
+			}
+			entry.Digest = digest
+			entry.Chunks = chunks
+		}
+
+		t.Entries = append(t.Entries, entry)
+	}
+
+	return t, nil
+}
+
+// countingReader wraps an io.Reader, tracking the total number of bytes
+// read so far so buildTOC can record each tar entry's absolute offset.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// digestTarEntry reads size bytes of the current tar entry from tr,
+// returning the whole-file digest along with ~chunkSize per-chunk digests.
+func digestTarEntry(tr *tar.Reader, size int64) (string, []tocChunk, error) {
+	h := sha256.New()
+	var chunks []tocChunk
+	remaining := size
+
+	for remaining > 0 {
+		n := int64(chunkSize)
+		if remaining < n {
+			n = remaining
+		}
+
+		ch := sha256.New()
+		written, err := io.CopyN(io.MultiWriter(h, ch), tr, n)
+		if err != nil {
+			return "", nil, fmt.Errorf("truncated tar entry: got %d of %d bytes: %v", written, n, err)
+		}
+
+		chunks = append(chunks, tocChunk{
+			Size:   written,
+			Digest: fmt.Sprintf("sha256-%x", ch.Sum(nil)),
+		})
+		remaining -= written
+	}
+
+	return fmt.Sprintf("sha256-%x", h.Sum(nil)), chunks, nil
+}
+
+// filterTOC returns the subset of t's entries that are named by fileMap or
+// are a parent directory of one of those paths, mirroring the filtering the
+// non-lazy Write path applies for a filtered RenderTreeStore.
+func filterTOC(t *toc, fileMap map[string]struct{}) *toc {
+	filtered := &toc{}
+	for _, e := range t.Entries {
+		name := strings.Trim(path.Clean("/"+e.Name), "/")
+		if _, ok := fileMap[name]; ok {
+			filtered.Entries = append(filtered.Entries, e)
+			continue
+		}
+		for p := range fileMap {
+			if strings.HasPrefix(p, name+"/") {
+				filtered.Entries = append(filtered.Entries, e)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// getTOC retrieves the TOC for key, if one was recorded (i.e. the blob was
+// imported through the lazy path).
+func (ds Store) getTOC(key string) (*toc, bool, error) {
+	tocj, err := ds.stores[tocType].Read(key)
+	if err != nil {
+		return nil, false, nil
+	}
+	t := &toc{}
+	if err := json.Unmarshal(tocj, t); err != nil {
+		return nil, false, fmt.Errorf("error unmarshalling TOC: %v", err)
+	}
+	return t, true, nil
+}
+
+// WriteLazy mounts a FUSE filesystem at the treestore's rootfs for tsKey,
+// instead of extracting the whole ACI. Directory and symlink structure is
+// served straight from the recorded TOC; regular file reads are satisfied
+// chunk-by-chunk, fetched from the local blob if present or via an HTTP
+// Range request against the image's Remote otherwise, with every chunk
+// verified against its TOC digest before being handed back to the kernel.
+// When fileMap is non-nil, the mounted tree is restricted to the paths it
+// names (plus their parent directories), matching the non-lazy Write path
+// so a filtered and a full lazy render of the same image stay independent.
+func (ts *TreeStore) WriteLazy(tsKey, key string, ds *Store, fileMap map[string]struct{}) error {
+	t, ok, err := ds.getTOC(key)
+	if err != nil {
+		return fmt.Errorf("error reading TOC: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("no TOC recorded for %q, cannot render lazily", key)
+	}
+	if len(fileMap) > 0 {
+		t = filterTOC(t, fileMap)
+	}
+
+	rootfs := ts.GetRootFS(tsKey)
+	if err := os.MkdirAll(rootfs, defaultPathPerm); err != nil {
+		return fmt.Errorf("error creating rootfs mountpoint: %v", err)
+	}
+
+	lfs := newLazyFS(t, lazyBlobSource{ds: ds, key: key, remoteURL: ds.remoteURLForKey(key)})
+
+	c, err := fuse.Mount(rootfs, fuse.FSName("rkt-lazy"), fuse.Subtype("rkt"), fuse.ReadOnly())
+	if err != nil {
+		return fmt.Errorf("error mounting lazy rootfs at %q: %v", rootfs, err)
+	}
+
+	go func() {
+		if err := fusefs.Serve(c, lfs); err != nil {
+			fmt.Fprintf(os.Stderr, "lazy rootfs for %q exited: %v\n", key, err)
+		}
+		c.Close()
+	}()
+
+	return nil
+}
+
+// remoteURLForKey looks up the ACIURL a blob key was originally fetched
+// from, if any, so a lazy mount can fall back to HTTP Range requests for
+// chunks that aren't in the local blob store yet.
+func (ds Store) remoteURLForKey(key string) string {
+	var url string
+	err := ds.db.Do(func(tx *sql.Tx) error {
+		return tx.QueryRow(`SELECT aciurl FROM remote WHERE blobkey == $1`, key).Scan(&url)
+	})
+	if err != nil {
+		return ""
+	}
+	return url
+}
+
+// checkLazyMount checks that a lazy treestore's rootfs can still be stat'ed
+// as a directory (a dead FUSE mount fails here) and that the TOC recorded
+// for the blob has entries. It does not compare that TOC with the one the
+// mount was built from, and does not re-verify any file or chunk digest.
+func checkLazyMount(rootfs string, want *toc) error {
+	fi, err := os.Stat(rootfs)
+	if err != nil {
+		// A crashed or manually-unmounted FUSE server surfaces here as
+		// ENOTCONN from the kernel on the next access.
+		return fmt.Errorf("lazy rootfs %q is not mounted: %v", rootfs, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("lazy rootfs %q is not a directory", rootfs)
+	}
+	if len(want.Entries) == 0 {
+		return fmt.Errorf("recorded TOC has no entries")
+	}
+	return nil
+}
+
+// lazyBlobSource fetches a single chunk of a lazily-rendered file: from the
+// local blob store if the full blob has since been downloaded, otherwise
+// via an HTTP Range request against the originating Remote.
+type lazyBlobSource struct {
+	ds        *Store
+	key       string
+	remoteURL string
+}
+
+// fetch returns the size bytes of tar data starting at tarOffset, verified
+// against digest.
+func (s lazyBlobSource) fetch(tarOffset, size int64, digest string) ([]byte, error) {
+	data, err := s.fetchLocal(tarOffset, size)
+	if err != nil {
+		data, err = s.fetchRemote(tarOffset, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := verifyChunkDigest(data, digest); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s lazyBlobSource) fetchLocal(tarOffset, size int64) ([]byte, error) {
+	rc, err := s.ds.ReadStream(s.key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	seeker, ok := rc.(io.Seeker)
+	if !ok {
+		return nil, fmt.Errorf("local blob stream isn't seekable")
+	}
+	if _, err := seeker.Seek(tarOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s lazyBlobSource) fetchRemote(tarOffset, size int64) ([]byte, error) {
+	if s.remoteURL == "" {
+		return nil, fmt.Errorf("chunk unavailable locally and no remote recorded for %q", s.key)
+	}
+
+	req, err := http.NewRequest("GET", s.remoteURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", tarOffset, tarOffset+size-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching range from %q: %v", s.remoteURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching range from %q: %s", s.remoteURL, resp.Status)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("error reading range body: %v", err)
+	}
+	return buf, nil
+}
+
+func verifyChunkDigest(data []byte, want string) error {
+	h := sha256.Sum256(data)
+	got := fmt.Sprintf("sha256-%x", h)
+	if got != want {
+		return fmt.Errorf("chunk digest mismatch: want %s, got %s", want, got)
+	}
+	return nil
+}
+
+// lazyFS is the FUSE filesystem served for a lazily-rendered treestore. Its
+// tree is built once from the TOC and is immutable for the lifetime of the
+// mount.
+type lazyFS struct {
+	root *lazyNode
+}
+
+// lazyNode is a single file, directory or symlink in the in-memory tree
+// built from a TOC. source is shared by every node and used only by regular
+// files to fetch their data on demand.
+type lazyNode struct {
+	entry    tocEntry
+	children map[string]*lazyNode
+	source   *lazyBlobSource
+}
+
+func newLazyFS(t *toc, source lazyBlobSource) *lazyFS {
+	root := &lazyNode{
+		entry:    tocEntry{Typeflag: tar.TypeDir, Mode: 0755},
+		children: map[string]*lazyNode{},
+		source:   &source,
+	}
+	for _, e := range t.Entries {
+		// The mount sits at the treestore's rootfs, so only the ACI's
+		// rootfs/ subtree is served, with that prefix stripped.
+		name := strings.Trim(path.Clean("/"+e.Name), "/")
+		if !strings.HasPrefix(name, "rootfs/") {
+			continue
+		}
+		root.insert(strings.Split(strings.TrimPrefix(name, "rootfs/"), "/"), e, &source)
+	}
+	return &lazyFS{root: root}
+}
+
+func (n *lazyNode) insert(parts []string, e tocEntry, source *lazyBlobSource) {
+	if len(parts) == 0 || parts[0] == "" {
+		return
+	}
+	name := parts[0]
+	child, ok := n.children[name]
+	if !ok {
+		child = &lazyNode{children: map[string]*lazyNode{}, source: source}
+		n.children[name] = child
+	}
+	if len(parts) == 1 {
+		child.entry = e
+		return
+	}
+	if child.entry.Typeflag == 0 {
+		child.entry.Typeflag = tar.TypeDir
+		child.entry.Mode = 0755
+	}
+	child.insert(parts[1:], e, source)
+}
+
+func (fs *lazyFS) Root() (fusefs.Node, error) {
+	return fs.root, nil
+}
+
+func (n *lazyNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = n.entry.Mode
+	a.Uid = uint32(n.entry.UID)
+	a.Gid = uint32(n.entry.GID)
+	switch n.entry.Typeflag {
+	case tar.TypeDir:
+		a.Mode |= os.ModeDir
+	case tar.TypeSymlink:
+		a.Mode |= os.ModeSymlink
+	default:
+		a.Size = uint64(n.entry.Size)
+	}
+	return nil
+}
+
+func (n *lazyNode) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	if child, ok := n.children[name]; ok {
+		return child, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (n *lazyNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirents := make([]fuse.Dirent, 0, len(n.children))
+	for name, child := range n.children {
+		typ := fuse.DT_File
+		switch child.entry.Typeflag {
+		case tar.TypeDir:
+			typ = fuse.DT_Dir
+		case tar.TypeSymlink:
+			typ = fuse.DT_Link
+		}
+		dirents = append(dirents, fuse.Dirent{Name: name, Type: typ})
+	}
+	return dirents, nil
+}
+
+func (n *lazyNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return n.entry.LinkTarget, nil
+}
+
+// Read serves a byte range of a regular file by fetching only the chunks
+// that overlap [req.Offset, req.Offset+req.Size), verifying each against
+// its TOC digest.
+func (n *lazyNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	var chunkOffset int64
+	start, end := req.Offset, req.Offset+int64(req.Size)
+	out := make([]byte, 0, req.Size)
+
+	for _, ch := range n.entry.Chunks {
+		chunkEnd := chunkOffset + ch.Size
+		if chunkEnd > start && chunkOffset < end {
+			data, err := n.sourceChunk(chunkOffset, ch)
+			if err != nil {
+				return err
+			}
+			lo, hi := int64(0), ch.Size
+			if start > chunkOffset {
+				lo = start - chunkOffset
+			}
+			if end < chunkEnd {
+				hi = end - chunkOffset
+			}
+			out = append(out, data[lo:hi]...)
+		}
+		chunkOffset = chunkEnd
+	}
+
+	resp.Data = out
+	return nil
+}
+
+// sourceChunk fetches a chunk whose data starts offset bytes into this
+// file; it's translated into the chunk's absolute position in the
+// uncompressed tar stream before being handed to the source.
+func (n *lazyNode) sourceChunk(offset int64, ch tocChunk) ([]byte, error) {
+	if n.source == nil {
+		return nil, fmt.Errorf("node has no data source")
+	}
+	return n.source.fetch(n.entry.Offset+offset, ch.Size, ch.Digest)
+}
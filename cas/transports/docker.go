@@ -0,0 +1,275 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transports
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	dockerDefaultRegistry = "registry-1.docker.io"
+	dockerManifestAccept  = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerMaxRetries      = 3
+)
+
+// dockerReference is the "docker://registry/repo:tag" transport. It speaks
+// just enough of the Docker Registry HTTP API v2 to list layers and fetch
+// blobs: manifest v2 schema2 lookup, bearer-token auth against the
+// challenge returned by a 401, and blob GETs with retry on transient
+// errors.
+type dockerReference struct {
+	registry string
+	repo     string
+	tag      string
+
+	client *http.Client
+}
+
+// parseDockerReference parses "docker://[registry/]repo[:tag]", defaulting
+// the registry to Docker Hub and the tag to "latest" exactly like the
+// docker CLI does.
+func parseDockerReference(ref string) (Reference, error) {
+	rest := strings.TrimPrefix(ref, "docker://")
+	if rest == "" {
+		return nil, fmt.Errorf("docker: empty reference")
+	}
+
+	tag := "latest"
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.Contains(rest[i:], "/") {
+		tag = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	registry := dockerDefaultRegistry
+	repo := rest
+	if i := strings.Index(rest, "/"); i >= 0 && looksLikeHost(rest[:i]) {
+		registry = rest[:i]
+		repo = rest[i+1:]
+	} else if !strings.Contains(rest, "/") {
+		repo = "library/" + rest
+	}
+
+	return &dockerReference{
+		registry: registry,
+		repo:     repo,
+		tag:      tag,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// looksLikeHost is a cheap heuristic to tell "docker.io/library/alpine"
+// (registry present) apart from "coreos/etcd" (no registry, just org/repo):
+// a registry component always contains a dot, a colon (port) or is
+// "localhost".
+func looksLikeHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+func (r *dockerReference) String() string {
+	return fmt.Sprintf("docker://%s/%s:%s", r.registry, r.repo, r.tag)
+}
+
+// do sends req, retrying transient (5xx and network) failures up to
+// dockerMaxRetries times, and transparently handles a 401 challenge by
+// fetching a bearer token and retrying once authenticated.
+func (r *dockerReference) do(req *http.Request) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= dockerMaxRetries; attempt++ {
+		resp, err := r.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			token, authErr := r.authenticate(resp)
+			resp.Body.Close()
+			if authErr != nil {
+				return nil, authErr
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("registry returned %s", resp.Status)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, fmt.Errorf("registry returned %s for %s", resp.Status, req.URL)
+		}
+
+		return resp, nil
+	}
+	return nil, fmt.Errorf("error contacting %s: %v", req.URL, lastErr)
+}
+
+// authenticate exchanges the WWW-Authenticate challenge on a 401 response
+// for a bearer token from the registry's token service, per the Docker
+// Registry v2 auth spec.
+func (r *dockerReference) authenticate(resp *http.Response) (string, error) {
+	challenge := resp.Header.Get("WWW-Authenticate")
+	params := parseAuthChallenge(challenge)
+	realm, service, scope := params["realm"], params["service"], params["scope"]
+	if realm == "" {
+		return "", fmt.Errorf("docker: no auth realm in challenge %q", challenge)
+	}
+
+	tokenURL := fmt.Sprintf("%s?service=%s&scope=%s", realm, service, scope)
+	tresp, err := r.client.Get(tokenURL)
+	if err != nil {
+		return "", fmt.Errorf("error fetching auth token: %v", err)
+	}
+	defer tresp.Body.Close()
+
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(tresp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("error parsing auth token response: %v", err)
+	}
+	if tok.Token != "" {
+		return tok.Token, nil
+	}
+	return tok.AccessToken, nil
+}
+
+func parseAuthChallenge(challenge string) map[string]string {
+	params := map[string]string{}
+	challenge = strings.TrimPrefix(challenge, "Bearer ")
+	for _, kv := range strings.Split(challenge, ",") {
+		kv = strings.TrimSpace(kv)
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		params[kv[:i]] = strings.Trim(kv[i+1:], `"`)
+	}
+	return params
+}
+
+type dockerManifest struct {
+	Config dockerDescriptor   `json:"config"`
+	Layers []dockerDescriptor `json:"layers"`
+}
+
+type dockerDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+func (r *dockerReference) manifestURL() string {
+	return fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.registry, r.repo, r.tag)
+}
+
+func (r *dockerReference) blobURL(digest string) string {
+	return fmt.Sprintf("https://%s/v2/%s/blobs/%s", r.registry, r.repo, digest)
+}
+
+func (r *dockerReference) fetchManifest() (*dockerManifest, error) {
+	req, err := http.NewRequest("GET", r.manifestURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dockerManifestAccept)
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest for %s: %v", r.String(), err)
+	}
+	defer resp.Body.Close()
+
+	var m dockerManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest for %s: %v", r.String(), err)
+	}
+	return &m, nil
+}
+
+func (r *dockerReference) fetchBlob(digest string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", r.blobURL(digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching blob %s: %v", digest, err)
+	}
+	return resp.Body, nil
+}
+
+func (r *dockerReference) Layers() ([]Layer, error) {
+	m, err := r.fetchManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]Layer, len(m.Layers))
+	for i, l := range m.Layers {
+		digest, mediaType := l.Digest, l.MediaType
+		layers[i] = Layer{
+			Digest: digest,
+			Open: func() (io.ReadCloser, error) {
+				rc, err := r.fetchBlob(digest)
+				if err != nil {
+					return nil, err
+				}
+				if !strings.Contains(mediaType, "gzip") {
+					return rc, nil
+				}
+				return gunzip(rc)
+			},
+		}
+	}
+	return layers, nil
+}
+
+func (r *dockerReference) Config() (*ImageConfig, error) {
+	m, err := r.fetchManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := r.fetchBlob(m.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config blob: %v", err)
+	}
+	defer body.Close()
+
+	var oc ociImageConfig
+	if err := json.NewDecoder(body).Decode(&oc); err != nil {
+		return nil, fmt.Errorf("error parsing config blob: %v", err)
+	}
+
+	exec := oc.Config.Entrypoint
+	exec = append(exec, oc.Config.Cmd...)
+
+	return &ImageConfig{
+		Exec:       exec,
+		Env:        oc.Config.Env,
+		WorkingDir: oc.Config.WorkingDir,
+	}, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transports
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociLayoutReference is the "oci-layout://path:tag" transport: a local
+// directory laid out per the OCI Image Layout spec (an "index.json" plus a
+// content-addressed "blobs/<alg>/<hex>" tree).
+type ociLayoutReference struct {
+	path string
+	tag  string
+}
+
+func parseOCILayoutReference(ref string) (Reference, error) {
+	rest := strings.TrimPrefix(ref, "oci-layout://")
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("oci-layout: missing \":tag\" in %q", ref)
+	}
+	path, tag := rest[:i], rest[i+1:]
+	if path == "" || tag == "" {
+		return nil, fmt.Errorf("oci-layout: malformed reference %q", ref)
+	}
+	return &ociLayoutReference{path: path, tag: tag}, nil
+}
+
+func (r *ociLayoutReference) String() string {
+	return fmt.Sprintf("oci-layout://%s:%s", r.path, r.tag)
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociImageConfig struct {
+	Config struct {
+		Env        []string `json:"Env"`
+		Entrypoint []string `json:"Entrypoint"`
+		Cmd        []string `json:"Cmd"`
+		WorkingDir string   `json:"WorkingDir"`
+	} `json:"config"`
+}
+
+func (r *ociLayoutReference) blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("oci-layout: malformed digest %q", digest)
+	}
+	return filepath.Join(r.path, "blobs", parts[0], parts[1]), nil
+}
+
+func (r *ociLayoutReference) findManifest() (*ociDescriptor, error) {
+	indexBytes, err := ioutil.ReadFile(filepath.Join(r.path, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading index.json: %v", err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, fmt.Errorf("error parsing index.json: %v", err)
+	}
+
+	for _, m := range index.Manifests {
+		if m.Annotations["org.opencontainers.image.ref.name"] == r.tag {
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("oci-layout: tag %q not found in %q", r.tag, r.path)
+}
+
+func (r *ociLayoutReference) readManifest() (*ociManifest, error) {
+	desc, err := r.findManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := r.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	mb, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest blob: %v", err)
+	}
+
+	var m ociManifest
+	if err := json.Unmarshal(mb, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest blob: %v", err)
+	}
+	return &m, nil
+}
+
+func (r *ociLayoutReference) Layers() ([]Layer, error) {
+	m, err := r.readManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]Layer, len(m.Layers))
+	for i, l := range m.Layers {
+		l := l
+		layers[i] = Layer{
+			Digest: l.Digest,
+			Open: func() (io.ReadCloser, error) {
+				p, err := r.blobPath(l.Digest)
+				if err != nil {
+					return nil, err
+				}
+				f, err := os.Open(p)
+				if err != nil {
+					return nil, err
+				}
+				if !strings.Contains(l.MediaType, "gzip") {
+					return f, nil
+				}
+				return gunzip(f)
+			},
+		}
+	}
+	return layers, nil
+}
+
+func (r *ociLayoutReference) Config() (*ImageConfig, error) {
+	m, err := r.readManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := r.blobPath(m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	cb, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config blob: %v", err)
+	}
+
+	var oc ociImageConfig
+	if err := json.Unmarshal(cb, &oc); err != nil {
+		return nil, fmt.Errorf("error parsing config blob: %v", err)
+	}
+
+	exec := oc.Config.Entrypoint
+	exec = append(exec, oc.Config.Cmd...)
+
+	return &ImageConfig{
+		Exec:       exec,
+		Env:        oc.Config.Env,
+		WorkingDir: oc.Config.WorkingDir,
+	}, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transports lets cas.Store.CopyFrom pull an image from somewhere
+// other than a plain ACI URL -- a Docker registry, an OCI image layout
+// directory, or a bare rootfs directory -- and convert it to an ACI on the
+// fly, mirroring the pluggable-transport design of the containers/image
+// project.
+package transports
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Layer is a single filesystem layer of a multi-layer image, identified by
+// the digest of its blob (as named by the source transport; for Docker and
+// OCI this is "sha256:<hex>"). Open may be called more than once and must
+// each time return a fresh tar stream starting at the beginning of the
+// layer.
+type Layer struct {
+	Digest string
+	Open   func() (io.ReadCloser, error)
+}
+
+// ImageConfig is the subset of a Docker/OCI image config needed to
+// synthesize an appc App for the converted ACI.
+type ImageConfig struct {
+	Exec       []string
+	Env        []string
+	WorkingDir string
+}
+
+// Reference names a single image in some external transport that
+// cas.Store.CopyFrom knows how to pull and convert to an ACI.
+type Reference interface {
+	// String returns the reference in its canonical "scheme://..." form,
+	// used as the Remote's ACIURL and TransportRef.
+	String() string
+
+	// Layers returns the image's layers in bottom-up (base first) order.
+	Layers() ([]Layer, error)
+
+	// Config returns the image's runtime configuration.
+	Config() (*ImageConfig, error)
+}
+
+// gunzippedLayer wraps a gzip.Reader over a layer blob's underlying stream,
+// closing both on Close so the caller doesn't have to track two handles.
+type gunzippedLayer struct {
+	*gzip.Reader
+	rc io.ReadCloser
+}
+
+func (g *gunzippedLayer) Close() error {
+	gzErr := g.Reader.Close()
+	if rcErr := g.rc.Close(); rcErr != nil {
+		return rcErr
+	}
+	return gzErr
+}
+
+// gunzip wraps rc in a gzip.Reader, for layer blobs whose mediaType marks
+// them as gzip-compressed tars -- real Docker registry layers and OCI
+// image-layout blobs virtually always are.
+func gunzip(rc io.ReadCloser) (io.ReadCloser, error) {
+	gzr, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("error opening gzip layer: %v", err)
+	}
+	return &gunzippedLayer{Reader: gzr, rc: rc}, nil
+}
+
+// ParseReference parses a "scheme://..." transport URL into the matching
+// Reference implementation. Supported schemes are "aci", "docker",
+// "oci-layout" and "dir".
+func ParseReference(ref string) (Reference, error) {
+	scheme := ref
+	if i := strings.Index(ref, "://"); i >= 0 {
+		scheme = ref[:i]
+	}
+
+	switch scheme {
+	case "aci":
+		return parseACIReference(ref)
+	case "docker":
+		return parseDockerReference(ref)
+	case "oci-layout":
+		return parseOCILayoutReference(ref)
+	case "dir":
+		return parseDirReference(ref)
+	default:
+		return nil, fmt.Errorf("transports: unknown scheme %q in %q", scheme, ref)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networking
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/vishvananda/netlink"
+)
+
+// checkpointIfaceState is the serialized form of a single interface's
+// addresses and routes, as recorded by Networking.Checkpoint and replayed by
+// Networking.Restore.
+type checkpointIfaceState struct {
+	Name   string       `json:"name"`
+	Addrs  []string     `json:"addrs"` // CIDR strings, as accepted by netlink.ParseAddr
+	Routes []routeState `json:"routes"`
+	MTU    int          `json:"mtu"`
+}
+
+type routeState struct {
+	Dst string `json:"dst,omitempty"` // CIDR, empty means default route
+	Gw  string `json:"gw,omitempty"`
+}
+
+// networkCheckpoint is the full network-side state a pod checkpoint embeds
+// under dir/network/.
+type networkCheckpoint struct {
+	Ifaces  []checkpointIfaceState `json:"ifaces"`
+	Results map[string]string      `json:"results"` // ifName -> raw CNI Result JSON, as cached in the results/ dir
+}
+
+// Checkpoint serializes the pod's network namespace state -- interface
+// addresses and routes, the cached CNI Results, and the netns file itself --
+// to dir/network/ and then unmounts the netns bind-mount so CRIU is free to
+// dump the namespace cleanly.
+func (n *Networking) Checkpoint(dir string) error {
+	netDir := filepath.Join(dir, "network")
+	if err := os.MkdirAll(netDir, 0700); err != nil {
+		return fmt.Errorf("error creating checkpoint network dir: %v", err)
+	}
+
+	var cp networkCheckpoint
+	cp.Results = map[string]string{}
+
+	err := withNetNS(n.hostNS, n.podNS, func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("error listing links: %v", err)
+		}
+
+		for _, link := range links {
+			if link.Attrs().Name == "lo" {
+				continue
+			}
+
+			state, err := dumpIfaceState(link)
+			if err != nil {
+				return err
+			}
+			cp.Ifaces = append(cp.Ifaces, state)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, an := range n.nets {
+		result, err := n.loadResult(an.ifName)
+		if err != nil {
+			return fmt.Errorf("error loading result for %q: %v", an.ifName, err)
+		}
+		cp.Results[an.ifName] = string(result)
+	}
+
+	cpj, err := json.MarshalIndent(&cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling network checkpoint: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(netDir, "state.json"), cpj, 0600); err != nil {
+		return fmt.Errorf("error writing network checkpoint: %v", err)
+	}
+
+	if err := copyFileToDir(n.podNSPath, netDir); err != nil {
+		return fmt.Errorf("error copying netns file into checkpoint: %v", err)
+	}
+
+	// Unmount our bind-mount of the netns so CRIU, which dumps the
+	// namespace by pid, doesn't see it referenced from two places.
+	if err := syscall.Unmount(n.podNSPath, 0); err != nil {
+		return fmt.Errorf("error unmounting %q for checkpoint: %v", n.podNSPath, err)
+	}
+
+	return nil
+}
+
+func dumpIfaceState(link netlink.Link) (checkpointIfaceState, error) {
+	state := checkpointIfaceState{
+		Name: link.Attrs().Name,
+		MTU:  link.Attrs().MTU,
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return state, fmt.Errorf("error listing addrs for %q: %v", state.Name, err)
+	}
+	for _, a := range addrs {
+		state.Addrs = append(state.Addrs, a.IPNet.String())
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return state, fmt.Errorf("error listing routes for %q: %v", state.Name, err)
+	}
+	for _, r := range routes {
+		rs := routeState{}
+		if r.Dst != nil {
+			rs.Dst = r.Dst.String()
+		}
+		if r.Gw != nil {
+			rs.Gw = r.Gw.String()
+		}
+		state.Routes = append(state.Routes, rs)
+	}
+
+	return state, nil
+}
+
+// Restore recreates the pod's network namespace from a prior Checkpoint.
+// basicNetNS only ever yields a fresh, lo-only namespace -- CRIU dumps and
+// restores the pod's mount/pid namespaces but the veth half living in the
+// host namespace doesn't travel with it -- so every non-loopback interface
+// has to be recreated the same way Setup made it in the first place (CNI
+// ADD, or the rootless tap path) before the checkpointed addresses and
+// routes can be replayed onto it. n.nets is rebuilt from that same step, so
+// the trailing Check() call has something real to verify.
+func (n *Networking) Restore(dir string) error {
+	netDir := filepath.Join(dir, "network")
+
+	cpj, err := ioutil.ReadFile(filepath.Join(netDir, "state.json"))
+	if err != nil {
+		return fmt.Errorf("error reading network checkpoint: %v", err)
+	}
+	var cp networkCheckpoint
+	if err := json.Unmarshal(cpj, &cp); err != nil {
+		return fmt.Errorf("error unmarshalling network checkpoint: %v", err)
+	}
+
+	if n.hostNS, n.podNS, err = basicNetNS(); err != nil {
+		return fmt.Errorf("error recreating netns: %v", err)
+	}
+	// we're in podNS!
+
+	if err := bindMountFile(selfNetNS, n.podNSPath); err != nil {
+		return fmt.Errorf("error re-binding netns at %q: %v", n.podNSPath, err)
+	}
+
+	nets, err := n.loadNets()
+	if err != nil {
+		return fmt.Errorf("error loading network definitions: %v", err)
+	}
+
+	if !hasNetAdmin() {
+		n.nets, err = n.setupRootlessNets(n.hostNS, n.podNS, nets)
+	} else {
+		err = withNetNS(n.podNS, n.hostNS, func() error {
+			n.nets, err = n.setupNets(n.podNSPath, nets)
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("error recreating network attachments: %v", err)
+	}
+
+	err = withNetNS(n.hostNS, n.podNS, func() error {
+		for _, ifs := range cp.Ifaces {
+			if err := replayIfaceState(ifs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// setupNets already saved a fresh Result for every CNI-plugin attachment
+	// as part of re-running ADD; only the rootless attachments (which don't
+	// go through ADD/saveResult) still need their Result restored from the
+	// checkpoint. Restoring the rest here would clobber the fresh result
+	// with the stale, pre-checkpoint one.
+	freshResult := map[string]bool{}
+	for _, an := range n.nets {
+		if !an.rootless {
+			freshResult[an.ifName] = true
+		}
+	}
+	for ifName, result := range cp.Results {
+		if freshResult[ifName] {
+			continue
+		}
+		if err := n.saveResult(ifName, []byte(result)); err != nil {
+			return fmt.Errorf("error restoring cached result for %q: %v", ifName, err)
+		}
+	}
+
+	return n.Check()
+}
+
+func replayIfaceState(ifs checkpointIfaceState) error {
+	link, err := netlink.LinkByName(ifs.Name)
+	if err != nil {
+		return fmt.Errorf("error finding restored link %q: %v", ifs.Name, err)
+	}
+
+	if ifs.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, ifs.MTU); err != nil {
+			return fmt.Errorf("error setting MTU on %q: %v", ifs.Name, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("error bringing up %q: %v", ifs.Name, err)
+	}
+
+	// setupNets/setupRootlessNets already ran a fresh ADD on this link,
+	// assigning it a new address via IPAM. Strip anything that isn't in the
+	// checkpoint before replaying the checkpointed addresses, so the
+	// interface doesn't end up doubly-addressed.
+	existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("error listing addrs on %q: %v", ifs.Name, err)
+	}
+	want := make(map[string]bool, len(ifs.Addrs))
+	for _, cidr := range ifs.Addrs {
+		want[cidr] = true
+	}
+	for _, a := range existing {
+		if want[a.IPNet.String()] {
+			continue
+		}
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return fmt.Errorf("error removing freshly-assigned addr %q from %q: %v", a.IPNet.String(), ifs.Name, err)
+		}
+	}
+
+	for _, cidr := range ifs.Addrs {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			return fmt.Errorf("error parsing addr %q: %v", cidr, err)
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("error adding addr %q to %q: %v", cidr, ifs.Name, err)
+		}
+	}
+
+	for _, rs := range ifs.Routes {
+		route := &netlink.Route{LinkIndex: link.Attrs().Index}
+		if rs.Dst != "" {
+			_, dst, err := net.ParseCIDR(rs.Dst)
+			if err != nil {
+				return fmt.Errorf("error parsing route dst %q: %v", rs.Dst, err)
+			}
+			route.Dst = dst
+		}
+		if rs.Gw != "" {
+			route.Gw = net.ParseIP(rs.Gw)
+		}
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("error adding route to %q: %v", ifs.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networking
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+)
+
+// defaultCNIVersion is the CNI config version assumed for plugins that
+// don't implement the VERSION command at all (pre-0.2.0 behavior).
+const defaultCNIVersion = "0.1.0"
+
+// supportedCNIVersions are the CNI config versions rkt is able to speak,
+// ordered from lowest to highest.
+var supportedCNIVersions = []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0"}
+
+// cniVersionResult is the reply a plugin gives to a VERSION invocation.
+type cniVersionResult struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
+
+// probePluginVersion invokes pluginPath with CNI_COMMAND=VERSION and parses
+// the {cniVersion, supportedVersions} reply from its stdout. Plugins that
+// don't understand VERSION exit non-zero or emit garbage; in that case we
+// assume defaultCNIVersion, matching pre-CNI-0.2.0 plugin behavior.
+func probePluginVersion(pluginPath string) (*cniVersionResult, error) {
+	cmd := exec.Cmd{
+		Path:   pluginPath,
+		Args:   []string{pluginPath},
+		Env:    append(os.Environ(), "CNI_COMMAND=VERSION"),
+		Stdin:  bytes.NewReader([]byte("{}")),
+		Stderr: os.Stderr,
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return &cniVersionResult{CNIVersion: defaultCNIVersion, SupportedVersions: []string{defaultCNIVersion}}, nil
+	}
+
+	vr := &cniVersionResult{}
+	if err := json.Unmarshal(out, vr); err != nil {
+		return &cniVersionResult{CNIVersion: defaultCNIVersion, SupportedVersions: []string{defaultCNIVersion}}, nil
+	}
+	if len(vr.SupportedVersions) == 0 {
+		vr.SupportedVersions = []string{vr.CNIVersion}
+	}
+	return vr, nil
+}
+
+// negotiateCNIVersion picks the highest config version both rkt and the
+// plugin are able to speak, returning an error if there is no overlap.
+func negotiateCNIVersion(pluginVersions []string) (string, error) {
+	best := ""
+	for _, ours := range supportedCNIVersions {
+		for _, theirs := range pluginVersions {
+			if ours == theirs {
+				best = ours
+			}
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no common CNI version between rkt (%v) and plugin (%v)", supportedCNIVersions, pluginVersions)
+	}
+	return best, nil
+}
+
+// rewriteConfVersion rewrites the "cniVersion" field of a raw CNI network
+// config so the plugin is invoked with the version negotiated between rkt
+// and the plugin, rather than whatever was originally on disk.
+func rewriteConfVersion(confBytes []byte, version string) ([]byte, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(confBytes, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing net conf: %v", err)
+	}
+	raw["cniVersion"] = version
+	return json.Marshal(raw)
+}
+
+// negotiatePluginVersion probes pluginPath with VERSION, picks the highest
+// config version both rkt and the plugin speak, and returns the net conf
+// read from confPath rewritten to that version.
+func (e *podEnv) negotiatePluginVersion(confPath, pluginPath string) ([]byte, string, error) {
+	confBytes, err := os.ReadFile(confPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading net conf: %v", err)
+	}
+
+	vr, err := probePluginVersion(pluginPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	version, err := negotiateCNIVersion(vr.SupportedVersions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rewritten, err := rewriteConfVersion(confBytes, version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return rewritten, version, nil
+}
+
+// buildResult assembles the minimal CNI Result JSON for an attachment, so it
+// can be cached and echoed back to CHECK the same way a real plugin-returned
+// Result would be.
+func (e *podEnv) buildResult(ip, hostIP net.IP) ([]byte, error) {
+	res := struct {
+		IP4 struct {
+			IP string `json:"ip"`
+		} `json:"ip4"`
+		HostIP string `json:"hostIP,omitempty"`
+	}{}
+	res.IP4.IP = ip.String()
+	if hostIP != nil {
+		res.HostIP = hostIP.String()
+	}
+	return json.Marshal(res)
+}
+
+// resultsDir returns the directory where the Result JSON recorded for each
+// attachment at ADD time is kept for CHECK, keyed by containerID and
+// interface name.
+func (e *podEnv) resultsDir() string {
+	return filepath.Join(e.rktRoot, "results")
+}
+
+func resultPath(dir string, podID types.UUID, ifName string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", podID.String(), ifName))
+}
+
+// saveResult persists the Result JSON recorded for an attachment at ADD time
+// (built by buildResult from its IPs, not the plugin's own ADD output) so
+// CHECK can send it back to the plugin. DEL does not read it.
+func (e *podEnv) saveResult(ifName string, result []byte) error {
+	dir := e.resultsDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(resultPath(dir, e.podID, ifName), result)
+}
+
+// loadResult reads back a previously saved ADD Result.
+func (e *podEnv) loadResult(ifName string) ([]byte, error) {
+	return os.ReadFile(resultPath(e.resultsDir(), e.podID, ifName))
+}
+
+func (e *podEnv) removeResult(ifName string) {
+	if err := os.Remove(resultPath(e.resultsDir(), e.podID, ifName)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing cached result for %q: %v", ifName, err)
+	}
+}
+
+// Check verifies that every active network attachment for the pod is still
+// correctly configured, by invoking each plugin with CNI_COMMAND=CHECK and
+// the Result JSON recorded at ADD time (see buildResult) on stdin. Like DEL, plugins are
+// invoked from the host netns and enter the pod netns themselves via
+// CNI_NETNS.
+func (n *Networking) Check() error {
+	if err := n.EnterHostNS(); err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, an := range n.nets {
+		if an.rootless {
+			// Not a CNI plugin attachment: nothing to reconcile via CHECK.
+			continue
+		}
+		if err := n.netPluginCheck(&an, n.podNSPath); err != nil {
+			errs = append(errs, fmt.Sprintf("%s(%s): %v", an.Name, an.ifName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("CNI CHECK failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// netPluginCheck invokes a single plugin's binary with CNI_COMMAND=CHECK,
+// feeding it the cached Result from ADD so the plugin can reconcile its
+// expectations against the live netns.
+func (e *podEnv) netPluginCheck(an *activeNet, netns string) error {
+	prevResult, err := e.loadResult(an.ifName)
+	if err != nil {
+		return fmt.Errorf("error loading cached result: %v", err)
+	}
+
+	conf, err := rewriteConfVersion(an.confBytes, an.cniVersion)
+	if err != nil {
+		return err
+	}
+
+	cmd := &exec.Cmd{
+		Path: an.Type,
+		Args: []string{an.Type},
+		Env: append(os.Environ(),
+			"CNI_COMMAND=CHECK",
+			"CNI_CONTAINERID="+e.podID.String(),
+			"CNI_NETNS="+netns,
+			"CNI_IFNAME="+an.ifName,
+			"CNI_ARGS="+strings.Join(an.args, ";"),
+		),
+		Stdin:  bytes.NewReader(append(conf, append([]byte("\n"), prevResult...)...)),
+		Stderr: os.Stderr,
+	}
+	if out, err := cmd.Output(); err != nil {
+		return fmt.Errorf("plugin %q CHECK failed: %v (%s)", an.Type, err, out)
+	}
+	return nil
+}
+
+// GC runs CNI_COMMAND=GC against every configured network, passing the list
+// of attachment IDs that are still valid so plugins can reap IPAM leases
+// and iptables rules left behind by pods that died without a teardown.
+func (n *Networking) GC(known []types.UUID) error {
+	if err := n.EnterHostNS(); err != nil {
+		return err
+	}
+
+	knownIDs := make([]string, len(known))
+	for i, u := range known {
+		knownIDs[i] = u.String()
+	}
+
+	var errs []string
+	for _, an := range n.nets {
+		if an.rootless {
+			// Not a CNI plugin attachment: no IPAM leases or iptables
+			// rules for a plugin binary to reap.
+			continue
+		}
+		if err := n.netPluginGC(&an, n.podNSPath, knownIDs); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", an.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("CNI GC failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (e *podEnv) netPluginGC(an *activeNet, netns string, knownIDs []string) error {
+	conf, err := rewriteConfVersion(an.confBytes, an.cniVersion)
+	if err != nil {
+		return err
+	}
+
+	gcArgs := struct {
+		CNIVersion string   `json:"cniVersion"`
+		ValidIDs   []string `json:"cni.dev/valid-attachments"`
+	}{an.cniVersion, knownIDs}
+	gcArgsJSON, err := json.Marshal(gcArgs)
+	if err != nil {
+		return err
+	}
+
+	cmd := &exec.Cmd{
+		Path: an.Type,
+		Args: []string{an.Type},
+		Env: append(os.Environ(),
+			"CNI_COMMAND=GC",
+			"CNI_NETNS="+netns,
+			"CNI_ARGS="+string(gcArgsJSON),
+		),
+		Stdin:  bytes.NewReader(conf),
+		Stderr: os.Stderr,
+	}
+	if out, err := cmd.Output(); err != nil {
+		return fmt.Errorf("plugin %q GC failed: %v (%s)", an.Type, err, out)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to path via a temp file + rename so a reader
+// never observes a partially-written result.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
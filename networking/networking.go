@@ -40,6 +40,23 @@ type activeNet struct {
 	ifName string
 	ip     net.IP
 	hostIP net.IP // kludge for default network
+
+	// confBytes and cniVersion are the raw net conf (rewritten to the
+	// negotiated version) and the CNI config version negotiated with the
+	// plugin binary, so CHECK and GC can re-invoke it identically to ADD.
+	confBytes  []byte
+	cniVersion string
+
+	// result is the Result JSON recorded at ADD time. buildResult rebuilds it
+	// from ip and hostIP, so it carries only those addresses and not the
+	// plugin's own ADD output; CHECK sends it back to the plugin.
+	result []byte
+
+	// rootless is set for an attachment brought up via setupRootlessNet
+	// instead of a CNI plugin. Its Type names the user-mode helper, not a
+	// plugin binary, so the CNI-oriented paths (teardownNets, Check, GC)
+	// must skip it rather than trying to exec it.
+	rootless bool
 }
 
 // "base" struct that's populated from the beginning
@@ -48,6 +65,10 @@ type activeNet struct {
 type podEnv struct {
 	rktRoot string
 	podID   types.UUID
+
+	// rootlessNets tracks user-mode networking attachments set up via
+	// setupRootlessNet, so Teardown can stop their helper processes.
+	rootlessNets []rootlessNet
 }
 
 // Networking describes the networking details of a pod.
@@ -96,12 +117,22 @@ func Setup(rktRoot string, podID types.UUID) (*Networking, error) {
 		return nil, fmt.Errorf("error loading network definitions: %v", err)
 	}
 
-	err = withNetNS(n.podNS, n.hostNS, func() error {
-		n.nets, err = n.setupNets(n.podNSPath, nets)
-		return err
-	})
-	if err != nil {
-		return nil, err
+	if !hasNetAdmin() {
+		// Unprivileged caller: skip netlink/CNI entirely and bring the pod
+		// up with the user-mode TCP/IP helper instead, while we're still in
+		// the freshly-created pod netns (tap devices must be created here).
+		n.nets, err = n.setupRootlessNets(n.hostNS, n.podNS, nets)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = withNetNS(n.podNS, n.hostNS, func() error {
+			n.nets, err = n.setupNets(n.podNSPath, nets)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(n.nets) == 0 {
@@ -136,6 +167,7 @@ func (n *Networking) Teardown() {
 		return
 	}
 
+	n.teardownRootlessNets()
 	n.teardownNets(n.podNSPath, n.nets)
 
 	if n.podNSPath == "" {
@@ -175,6 +207,16 @@ func (n *Networking) EnterPodNS() error {
 	return util.SetNS(n.podNS, syscall.CLONE_NEWNET)
 }
 
+// NetworkNames returns the configured name of each active network
+// attachment, in the same order as they were set up.
+func (n *Networking) NetworkNames() []string {
+	names := make([]string, len(n.nets))
+	for i, an := range n.nets {
+		names[i] = an.Name
+	}
+	return names
+}
+
 func (e *podEnv) netDir() string {
 	return filepath.Join(e.rktRoot, "net")
 }
@@ -200,12 +242,33 @@ func (e *podEnv) setupNets(netns string, nets []Net) ([]activeNet, error) {
 			break
 		}
 
-		an.ip, an.hostIP, err = e.netPluginAdd(&nt, netns, nt.args, an.ifName)
+		if an.confBytes, an.cniVersion, err = e.negotiatePluginVersion(an.Filename, nt.Type); err != nil {
+			err = fmt.Errorf("error negotiating CNI version for %q: %v", nt.Name, err)
+			break
+		}
+
+		// Persist the negotiated, rewritten conf back to an.Filename so ADD
+		// sees the same version CHECK and GC later invoke the plugin with.
+		if err = writeFileAtomic(an.Filename, an.confBytes); err != nil {
+			err = fmt.Errorf("error writing negotiated net conf for %q: %v", nt.Name, err)
+			break
+		}
+
+		an.ip, an.hostIP, err = e.netPluginAdd(&an.Net, netns, nt.args, an.ifName)
 		if err != nil {
 			err = fmt.Errorf("error adding network %q: %v", nt.Name, err)
 			break
 		}
 
+		if an.result, err = e.buildResult(an.ip, an.hostIP); err != nil {
+			err = fmt.Errorf("error recording result for %q: %v", nt.Name, err)
+			break
+		}
+		if err = e.saveResult(an.ifName, an.result); err != nil {
+			err = fmt.Errorf("error persisting result for %q: %v", nt.Name, err)
+			break
+		}
+
 		active = append(active, an)
 	}
 
@@ -220,6 +283,11 @@ func (e *podEnv) setupNets(netns string, nets []Net) ([]activeNet, error) {
 func (e *podEnv) teardownNets(netns string, nets []activeNet) {
 	for i := len(nets) - 1; i >= 0; i-- {
 		nt := nets[i]
+		if nt.rootless {
+			// Torn down by teardownRootlessNets instead: nt.Type is the
+			// user-mode helper's name, not a CNI plugin binary to exec.
+			continue
+		}
 
 		log.Printf("Teardown: executing net-plugin %v", nt.Type)
 
@@ -228,6 +296,10 @@ func (e *podEnv) teardownNets(netns string, nets []activeNet) {
 			log.Printf("Error deleting %q: %v", nt.Name, err)
 		}
 
+		// The cached ADD result is only useful while the attachment is
+		// live; drop it now that DEL has run.
+		e.removeResult(nt.ifName)
+
 		// Delete the conf file to signal that the network was
 		// torn down (or at least attempted to)
 		if err = os.Remove(nt.Filename); err != nil {
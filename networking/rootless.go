@@ -0,0 +1,301 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package networking
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/coreos/rkt/networking/util"
+)
+
+// rootlessNetType is the Net.Type value naming the user-mode TCP/IP helper
+// variant. The helper path itself is chosen by hasNetAdmin, not by this
+// value: Setup and Restore take it for every configured network when the
+// caller lacks CAP_NET_ADMIN.
+const rootlessNetType = "rootless-usernet"
+
+const (
+	tunDevPath  = "/dev/net/tun"
+	tapIfName   = "tap0"
+	netnsProxy  = "rkt-netns-proxy"
+	iffTap      = 0x0002
+	iffNoPi     = 0x1000
+	tunSetIff   = 0x400454ca
+	capNetAdmin = 12 // bit index in /proc/self/status Cap* masks
+)
+
+// PortForward describes a single host-port -> pod-port forward handled by
+// the rootless user-mode stack.
+type PortForward struct {
+	Proto    string `json:"proto"` // "tcp" or "udp"
+	HostPort int    `json:"hostPort"`
+	PodPort  int    `json:"podPort"`
+}
+
+// rootlessConf is the "rootless-usernet" Net variant's plugin configuration,
+// normally embedded in the net conf JSON alongside name/type.
+type rootlessConf struct {
+	MTU          int           `json:"mtu"`
+	IPv4Range    string        `json:"ipv4Range"`
+	IPv6Range    string        `json:"ipv6Range"`
+	PortForwards []PortForward `json:"portForwards"`
+}
+
+// rootlessNet tracks the state needed to tear down a user-mode networking
+// attachment: the proxy helper's pid so Teardown can signal it.
+type rootlessNet struct {
+	conf     rootlessConf
+	proxyPid int
+}
+
+// hasNetAdmin reports whether the calling process holds CAP_NET_ADMIN in its
+// effective capability set, by parsing /proc/self/status. Processes without
+// it can't create veths or manipulate the host's iptables, so Setup falls
+// back to the user-mode networking path for them.
+func hasNetAdmin() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		// If we can't tell, assume the worst and take the unprivileged path.
+		return false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return false
+		}
+		mask, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return false
+		}
+		return mask&(1<<capNetAdmin) != 0
+	}
+	return false
+}
+
+// setupRootlessNets brings up every configured network using the user-mode
+// helper path. It must be called while still inside the freshly-unshared pod
+// netns, since tap devices can only be created there.
+func (e *podEnv) setupRootlessNets(hostNS, podNS *os.File, nets []Net) ([]activeNet, error) {
+	active := []activeNet{}
+	for i, nt := range nets {
+		ifName := fmt.Sprintf(ifnamePattern, i)
+		_, an, err := e.setupRootlessNet(hostNS, podNS, &nt, ifName)
+		if err != nil {
+			e.teardownRootlessNets()
+			return nil, fmt.Errorf("error adding rootless network %q: %v", nt.Name, err)
+		}
+		active = append(active, *an)
+	}
+	return active, nil
+}
+
+// setupRootlessNet brings up a single "rootless-usernet" attachment: it
+// creates a tap device inside the (already entered) pod netns, hands the tap
+// fd to a rkt-netns-proxy helper running in the host netns via SCM_RIGHTS,
+// and records the helper's pid so Teardown can stop it.
+func (e *podEnv) setupRootlessNet(hostNS, podNS *os.File, nt *Net, ifName string) (ip net.IP, an *activeNet, err error) {
+	var conf rootlessConf
+	confBytes, err := ioutil.ReadFile(nt.Filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading rootless net conf: %v", err)
+	}
+	if err := json.Unmarshal(confBytes, &conf); err != nil {
+		return nil, nil, fmt.Errorf("error parsing rootless net conf: %v", err)
+	}
+
+	tapFile, err := createTap(tapIfName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating tap device %q: %v", tapIfName, err)
+	}
+	defer tapFile.Close()
+
+	sp, err := newSocketpair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating control socket: %v", err)
+	}
+	defer sp.Close()
+
+	pid, err := withNetNSPid(hostNS, func() (int, error) {
+		return spawnNetnsProxy(sp.proxyEnd, conf)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error starting %s: %v", netnsProxy, err)
+	}
+
+	if err := sp.sendFile(tapFile); err != nil {
+		syscall.Kill(pid, syscall.SIGTERM)
+		return nil, nil, fmt.Errorf("error passing tap fd to %s: %v", netnsProxy, err)
+	}
+
+	podIP, _, err := net.ParseCIDR(conf.IPv4Range)
+	if err != nil {
+		syscall.Kill(pid, syscall.SIGTERM)
+		return nil, nil, fmt.Errorf("error parsing ipv4Range %q: %v", conf.IPv4Range, err)
+	}
+
+	an = &activeNet{
+		Net:      *nt,
+		ifName:   ifName,
+		ip:       podIP,
+		rootless: true,
+	}
+	e.rootlessNets = append(e.rootlessNets, rootlessNet{conf: conf, proxyPid: pid})
+
+	return podIP, an, nil
+}
+
+// teardownRootlessNets stops every rkt-netns-proxy helper started by
+// setupRootlessNet.
+func (e *podEnv) teardownRootlessNets() {
+	for _, rn := range e.rootlessNets {
+		if rn.proxyPid <= 0 {
+			continue
+		}
+		if err := syscall.Kill(rn.proxyPid, syscall.SIGTERM); err != nil {
+			log.Printf("Error stopping %s (pid %d): %v", netnsProxy, rn.proxyPid, err)
+		}
+	}
+	e.rootlessNets = nil
+}
+
+// createTap creates a tap device named ifName in the current network
+// namespace and returns it opened from /dev/net/tun. The device is not made
+// persistent: it exists only while a file descriptor on it stays open.
+func createTap(ifName string) (*os.File, error) {
+	f, err := os.OpenFile(tunDevPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifr struct {
+		name  [16]byte
+		flags int16
+		_     [22]byte
+	}
+	copy(ifr.name[:], ifName)
+	ifr.flags = iffTap | iffNoPi
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(tunSetIff), uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		f.Close()
+		return nil, errno
+	}
+
+	return f, nil
+}
+
+// socketpair wraps a connected pair of unix sockets used to pass the tap fd
+// from the pod netns to the rkt-netns-proxy helper running in the host
+// netns.
+type socketpair struct {
+	local    *net.UnixConn
+	proxyEnd *os.File
+}
+
+func newSocketpair() (*socketpair, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	localFile := os.NewFile(uintptr(fds[0]), "rootless-ctl-local")
+	conn, err := net.FileConn(localFile)
+	localFile.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, err
+	}
+
+	return &socketpair{
+		local:    conn.(*net.UnixConn),
+		proxyEnd: os.NewFile(uintptr(fds[1]), "rootless-ctl-proxy"),
+	}, nil
+}
+
+func (sp *socketpair) sendFile(f *os.File) error {
+	rights := syscall.UnixRights(int(f.Fd()))
+	_, _, err := sp.local.WriteMsgUnix([]byte{0}, rights, nil)
+	return err
+}
+
+func (sp *socketpair) Close() {
+	sp.local.Close()
+	sp.proxyEnd.Close()
+}
+
+// spawnNetnsProxy forks/execs the rkt-netns-proxy helper binary, passing it
+// the host-side of the control socket as its first extra file descriptor. It
+// must be called while already in the host netns.
+func spawnNetnsProxy(ctlEnd *os.File, conf rootlessConf) (int, error) {
+	path, err := exec.LookPath(netnsProxy)
+	if err != nil {
+		return 0, fmt.Errorf("%s not found in PATH: %v", netnsProxy, err)
+	}
+
+	args := []string{path, "--mtu", strconv.Itoa(conf.MTU), "--ipv4-range", conf.IPv4Range}
+	if conf.IPv6Range != "" {
+		args = append(args, "--ipv6-range", conf.IPv6Range)
+	}
+	for _, pf := range conf.PortForwards {
+		args = append(args, "--port-forward", fmt.Sprintf("%s:%d:%d", pf.Proto, pf.HostPort, pf.PodPort))
+	}
+
+	cmd := exec.Cmd{
+		Path:       path,
+		Args:       args,
+		ExtraFiles: []*os.File{ctlEnd},
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	return cmd.Process.Pid, nil
+}
+
+// withNetNSPid runs f() after entering tgtNS, returning to the caller's
+// current netns afterwards, and propagates f's (int, error) result.
+func withNetNSPid(tgtNS *os.File, f func() (int, error)) (pid int, err error) {
+	cur, err := os.Open(selfNetNS)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close()
+
+	if err := util.SetNS(tgtNS, syscall.CLONE_NEWNET); err != nil {
+		return 0, err
+	}
+	defer util.SetNS(cur, syscall.CLONE_NEWNET)
+
+	return f()
+}
@@ -0,0 +1,285 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build linux
+
+package stage0
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/coreos/rkt/common"
+	"github.com/coreos/rkt/networking"
+	"github.com/coreos/rkt/version"
+)
+
+// specDump is the pod-level metadata recorded alongside a checkpoint image,
+// so "rkt list --checkpoints" and cross-host migration can inspect a
+// checkpoint without rendering its (potentially large) CRIU dump.
+type specDump struct {
+	RktVersion    string   `json:"rktVersion"`
+	KernelVersion string   `json:"kernelVersion"`
+	Images        []string `json:"images"` // image keys, in app order
+	Networks      []string `json:"networks"`
+}
+
+// Checkpoint freezes a running pod: it asks the pod's Networking to
+// serialize interface state and unmount the netns, invokes the stage1
+// checkpoint entrypoint (which drives the actual CRIU dump of the app
+// processes), and stores the resulting image plus a spec.dump describing it
+// in the CAS checkpoint store.
+func Checkpoint(cfg CommonConfig, dir string, n *networking.Networking) (string, error) {
+	ep, err := getStage1Entrypoint(dir, checkpointEntrypoint)
+	if err != nil {
+		return "", fmt.Errorf("error determining checkpoint entrypoint: %v", err)
+	}
+
+	dumpDir, err := ioutil.TempDir("", "rkt-checkpoint-")
+	if err != nil {
+		return "", fmt.Errorf("error creating checkpoint scratch dir: %v", err)
+	}
+	defer os.RemoveAll(dumpDir)
+
+	if err := n.Checkpoint(dumpDir); err != nil {
+		return "", fmt.Errorf("error checkpointing pod network: %v", err)
+	}
+
+	if err := writeSpecDump(cfg, n, dumpDir); err != nil {
+		return "", fmt.Errorf("error writing spec.dump: %v", err)
+	}
+
+	args := []string{filepath.Join(common.Stage1RootfsPath(dir), ep), "--dump-dir", dumpDir, cfg.UUID.String()}
+	cmd := exec.Cmd{
+		Path:   args[0],
+		Args:   args,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running checkpoint entrypoint: %v", err)
+	}
+
+	image, err := archiveDir(dumpDir)
+	if err != nil {
+		return "", fmt.Errorf("error archiving checkpoint: %v", err)
+	}
+	defer image.Close()
+
+	meta := map[string]string{"rktVersion": version.Version}
+	key, err := cfg.Store.WriteCheckpoint(cfg.UUID.String(), image, meta)
+	if err != nil {
+		return "", fmt.Errorf("error storing checkpoint: %v", err)
+	}
+
+	return key, nil
+}
+
+// Restore thaws a pod from a previously-stored checkpoint: it unpacks the
+// checkpoint image, recreates and reconciles the pod's networking, and
+// invokes the stage1 restore entrypoint to resume the app processes under
+// CRIU.
+func Restore(cfg CommonConfig, dir string, key string, n *networking.Networking) error {
+	ep, err := getStage1Entrypoint(dir, restoreEntrypoint)
+	if err != nil {
+		return fmt.Errorf("error determining restore entrypoint: %v", err)
+	}
+
+	image, err := cfg.Store.OpenCheckpoint(key)
+	if err != nil {
+		return fmt.Errorf("error opening checkpoint: %v", err)
+	}
+	defer image.Close()
+
+	restoreDir, err := ioutil.TempDir("", "rkt-restore-")
+	if err != nil {
+		return fmt.Errorf("error creating restore scratch dir: %v", err)
+	}
+	defer os.RemoveAll(restoreDir)
+
+	if err := unarchiveDir(image, restoreDir); err != nil {
+		return fmt.Errorf("error unpacking checkpoint: %v", err)
+	}
+
+	if err := n.Restore(restoreDir); err != nil {
+		return fmt.Errorf("error restoring pod network: %v", err)
+	}
+
+	args := []string{filepath.Join(common.Stage1RootfsPath(dir), ep), "--restore-dir", restoreDir, cfg.UUID.String()}
+	cmd := exec.Cmd{
+		Path:   args[0],
+		Args:   args,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running restore entrypoint: %v", err)
+	}
+
+	return nil
+}
+
+func writeSpecDump(cfg CommonConfig, n *networking.Networking, dumpDir string) error {
+	images := make([]string, len(cfg.Images))
+	for i, img := range cfg.Images {
+		images[i] = img.String()
+	}
+
+	sd := specDump{
+		RktVersion:    version.Version,
+		KernelVersion: kernelVersion(),
+		Images:        images,
+		Networks:      n.NetworkNames(),
+	}
+
+	sdj, err := json.MarshalIndent(&sd, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dumpDir, "spec.dump"), sdj, 0644)
+}
+
+// archiveDir tars and gzips dumpDir into a temp file, returning it opened
+// for reading so the caller can hand it straight to cas.Store.WriteCheckpoint.
+func archiveDir(dumpDir string) (*os.File, error) {
+	fh, err := ioutil.TempFile("", "rkt-checkpoint-archive-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(fh.Name()) // unlink now, the open fd keeps it alive until Close
+
+	gw := gzip.NewWriter(fh)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dumpDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	return fh, nil
+}
+
+// unarchiveDir extracts a checkpoint archive produced by archiveDir into
+// destDir.
+func unarchiveDir(r io.Reader, destDir string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dst := filepath.Join(destDir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func kernelVersion() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		log.Printf("Error reading kernel version: %v", err)
+		return ""
+	}
+	buf := make([]byte, 0, len(uts.Release))
+	for _, b := range uts.Release {
+		if b == 0 {
+			break
+		}
+		buf = append(buf, byte(b))
+	}
+	return string(buf)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build linux
+
+package stage0
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+	"github.com/coreos/rkt/cas"
+	"github.com/coreos/rkt/common"
+)
+
+// CreateDepListFromImageID resolves img's full transitive dependency graph,
+// the same walk appc's own resolver does, and renders a tree store for
+// every dependency in it (img's own tree store is left to the caller) so
+// each one is ready to be stacked as its own overlay lowerdir. The returned keys are ordered
+// base-first, i.e. the reverse of overlay mount order.
+func CreateDepListFromImageID(store *cas.Store, img types.Hash) ([]string, error) {
+	deps, err := store.Dependencies(img.String())
+	if err != nil {
+		return nil, fmt.Errorf("error resolving dependencies of %s: %v", img, err)
+	}
+
+	for _, dep := range deps {
+		if err := store.RenderTreeStore(dep, false, false, nil); err != nil {
+			return nil, fmt.Errorf("error rendering dependency %s: %v", dep, err)
+		}
+	}
+
+	return deps, nil
+}
+
+// writeDepList records deps, most-specific-first (the order Run needs to
+// stack them as lowerdir=depN:...:dep1:base), into dest's deps.list.
+func writeDepList(dest string, deps []string) error {
+	ordered := make([]string, len(deps))
+	for i, dep := range deps {
+		ordered[len(deps)-1-i] = dep
+	}
+
+	fn := filepath.Join(dest, common.DepsListFilename)
+	return ioutil.WriteFile(fn, []byte(strings.Join(ordered, "\n")+"\n"), 0644)
+}
+
+// readDepList reads back a deps.list written by writeDepList. A missing or
+// empty deps.list (writeDepList writes an empty one for an image with no
+// dependencies) yields an empty list, not an error.
+func readDepList(dest string) ([]string, error) {
+	fn := filepath.Join(dest, common.DepsListFilename)
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", fn, err)
+	}
+
+	trimmed := strings.TrimRight(string(b), "\n")
+	if trimmed == "" {
+		return nil, nil
+	}
+	return strings.Split(trimmed, "\n"), nil
+}
@@ -26,8 +26,10 @@ import (
 )
 
 const (
-	enterEntrypoint = "coreos.com/rkt/stage1/enter"
-	runEntrypoint   = "coreos.com/rkt/stage1/run"
+	enterEntrypoint      = "coreos.com/rkt/stage1/enter"
+	runEntrypoint        = "coreos.com/rkt/stage1/run"
+	checkpointEntrypoint = "coreos.com/rkt/stage1/checkpoint"
+	restoreEntrypoint    = "coreos.com/rkt/stage1/restore"
 )
 
 // getEntrypoint retrieves the named entrypoint from the stage1 manifest for a given pod
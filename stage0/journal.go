@@ -0,0 +1,64 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build linux
+
+package stage0
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/rkt/common"
+	"github.com/coreos/rkt/pkg/acl"
+)
+
+// setupJournalACL creates the pod's journal directory and grants
+// cfg.LogGroup (or common.RktGroup, if unset) read+execute access to it via
+// a default POSIX ACL, so unprivileged members of that group can
+// "journalctl -M" into the pod without needing to be root themselves. It's
+// a no-op when cfg.NoLogACL is set, and a no-op with a warning, rather than
+// a hard failure, on filesystems that don't support ACLs.
+func setupJournalACL(cfg RunConfig, dir string) error {
+	if cfg.NoLogACL {
+		return nil
+	}
+
+	journalDir := filepath.Join(common.Stage1RootfsPath(dir), "var/log/journal")
+	if err := os.MkdirAll(journalDir, 0755); err != nil {
+		return fmt.Errorf("error creating journal directory: %v", err)
+	}
+
+	group := cfg.LogGroup
+	if group == "" {
+		group = common.RktGroup
+	}
+	gid, err := common.LookupGid(group)
+	if err != nil {
+		return fmt.Errorf("error looking up group %q: %v", group, err)
+	}
+
+	aclSpec := fmt.Sprintf("g:%d:r-x,m:r-x", gid)
+	if err := acl.SetDefault(journalDir, aclSpec); err != nil {
+		if acl.IsNotSupported(err) {
+			log.Printf("Warning: default ACLs not supported on %s, skipping journal ACL setup", journalDir)
+			return nil
+		}
+		return fmt.Errorf("error setting journal ACL: %v", err)
+	}
+
+	return nil
+}
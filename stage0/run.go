@@ -25,6 +25,7 @@ package stage0
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -41,6 +42,7 @@ import (
 	"github.com/coreos/rkt/cas"
 	"github.com/coreos/rkt/common"
 	"github.com/coreos/rkt/pkg/aci"
+	"github.com/coreos/rkt/pkg/keystore"
 	"github.com/coreos/rkt/pkg/sys"
 	"github.com/coreos/rkt/version"
 )
@@ -48,12 +50,28 @@ import (
 // configuration parameters required by Prepare
 type PrepareConfig struct {
 	CommonConfig
-	// TODO(jonboulle): These images are partially-populated hashes, this should be clarified.
-	ExecAppends [][]string     // appendages to each image's app.exec lines (empty when none, length should match length of Images)
-	InheritEnv  bool           // inherit parent environment into apps
-	ExplicitEnv []string       // always set these environment variables for all the apps
-	Volumes     []types.Volume // list of volumes that rkt can provide to applications
-	UseOverlay  bool           // prepare pod with overlay fs
+	Apps         []AppConfig    // per-app configuration, aligned 1:1 with the apps making up the pod
+	InheritEnv   bool           // inherit parent environment into apps
+	ExplicitEnv  []string       // always set these environment variables for all the apps
+	Volumes      []types.Volume // list of volumes that rkt can provide to applications
+	UseOverlay   bool           // prepare pod with overlay fs
+	PrivateUsers PrivateUsers   // uid/gid range to shift the pod's rootfs into, if enabled
+}
+
+// AppConfig carries everything Prepare needs to know about a single app in
+// the pod, replacing the old ExecAppends slice that was aligned to Images
+// by position alone -- a mismatch between the two was a runtime surprise
+// rather than a compile- or validation-time error. Zero-valued fields leave
+// the corresponding setting from the app's own image manifest untouched.
+type AppConfig struct {
+	ImageHash      types.Hash     // hash of the app's image, as it appears in CommonConfig.Images
+	ExecAppend     []string       // appendages to the app's app.exec line
+	Env            []string       // additional environment variables, in os.Environ() key=value format
+	MountOverrides []schema.Mount // runtime mount point overrides
+	User           string         // overrides the image manifest's App.User when non-empty
+	Group          string         // overrides the image manifest's App.Group when non-empty
+	WorkingDir     string         // overrides the image manifest's App.WorkingDirectory when non-empty
+	ReadOnlyRootfs bool           // mount the app's rootfs read-only
 }
 
 // configuration parameters needed by Run
@@ -62,7 +80,25 @@ type RunConfig struct {
 	PrivateNet           bool // pod should have its own network stack
 	SpawnMetadataService bool // launch metadata service
 	LockFd               int  // lock file descriptor
-	Interactive          bool // whether the pod is interactive or not
+	PrivateUsers         PrivateUsers
+}
+
+// PrivateUsers describes the host uid/gid range a pod's root filesystem is
+// shifted into, letting the pod run as root inside its own user namespace
+// while mapping to an unprivileged range on the host. It corresponds to
+// the --private-users=<shift>:<count> flag on both Prepare and Run.
+type PrivateUsers struct {
+	Shift uint32 // first host uid/gid mapped to container uid/gid 0
+	Count uint32 // number of uids/gids mapped
+}
+
+// Enabled reports whether a uid/gid range has actually been configured.
+func (pu PrivateUsers) Enabled() bool {
+	return pu.Count > 0
+}
+
+func (pu PrivateUsers) String() string {
+	return fmt.Sprintf("%d:%d", pu.Shift, pu.Count)
 }
 
 // configuration shared by both Run and Prepare
@@ -73,6 +109,87 @@ type CommonConfig struct {
 	Images      []types.Hash // application images
 	PodsDir     string       // root directory for rkt pods
 	Debug       bool
+
+	// TrustedKeystore holds the set of signing keys Prepare trusts. If
+	// nil, images are not required to be signed at all (equivalent to
+	// InsecureSkipVerify).
+	TrustedKeystore *keystore.Keystore
+
+	// InsecureSkipVerify disables signature verification entirely. Maps
+	// to the --insecure-skip-verify flag.
+	InsecureSkipVerify bool
+
+	// AllowAnyArch lets an image's os/arch labels diverge from the host's,
+	// so long as they're otherwise a valid combination. Maps to the
+	// --allow-any-arch flag; intended for CI that only needs an image's
+	// contents, not to actually execute it.
+	AllowAnyArch bool
+
+	// Interactive marks the pod as interactive, hooking the app up to the
+	// terminal rather than running it detached. Prepare rejects this for
+	// any pod without exactly one app (see ErrInteractiveMultiApp); it lives
+	// here, not on RunConfig alone, so that check can happen up front
+	// instead of being deferred to stage1.
+	Interactive bool
+
+	// LogGroup is the group Run grants read+execute access to the pod's
+	// journal directory, via a default POSIX ACL, so its members can
+	// "journalctl -M" into the pod without needing to be root. Defaults to
+	// common.RktGroup ("rkt") when empty.
+	LogGroup string
+
+	// NoLogACL skips the journal ACL setup entirely, for filesystems that
+	// don't support POSIX ACLs. Maps to the --no-log-acl flag.
+	NoLogACL bool
+
+	// PerAppFileMap restricts, for any app listed here, tree store
+	// extraction to only the given paths (plus their parent directories)
+	// instead of the whole image -- e.g. a single static binary out of a
+	// fat base image. Populated from --extract-only=app=path1,path2.
+	// Apps not present here are rendered in full. It lives on CommonConfig,
+	// not PrepareConfig, because Run must reconstruct the same filtered
+	// tree store key Prepare rendered under.
+	PerAppFileMap map[types.Hash]map[string]struct{}
+}
+
+// ErrInteractiveMultiApp is returned by Prepare when CommonConfig.Interactive
+// is set for a pod without exactly one app. Interactive mode hooks a single
+// app up to the terminal, which isn't meaningful for a multi-app pod; this
+// used to be caught deep inside stage1 instead of at prepare time.
+var ErrInteractiveMultiApp = errors.New("stage0: interactive mode requires a pod with exactly one app")
+
+// ErrAppImagesMismatch is returned by Prepare when CommonConfig.Images
+// doesn't name exactly the set of image hashes carried by PrepareConfig.Apps.
+// The two are independent fields rather than one being derived from the
+// other -- RunConfig shares CommonConfig but has no Apps of its own -- so
+// nothing else keeps them in sync.
+var ErrAppImagesMismatch = errors.New("stage0: CommonConfig.Images does not match the image hashes in PrepareConfig.Apps")
+
+// validateAppImages checks that images names exactly the set of hashes
+// carried by apps' ImageHash fields, so a caller can't verify one set of
+// images (via verifyImages, which reads CommonConfig.Images) while actually
+// preparing a different set (via PrepareConfig.Apps).
+func validateAppImages(apps []AppConfig, images []types.Hash) error {
+	if len(apps) != len(images) {
+		return ErrAppImagesMismatch
+	}
+	want := make(map[types.Hash]bool, len(images))
+	for _, img := range images {
+		want[img] = true
+	}
+	have := make(map[types.Hash]bool, len(apps))
+	for _, app := range apps {
+		if !want[app.ImageHash] {
+			return ErrAppImagesMismatch
+		}
+		have[app.ImageHash] = true
+	}
+	for _, img := range images {
+		if !have[img] {
+			return ErrAppImagesMismatch
+		}
+	}
+	return nil
 }
 
 func init() {
@@ -108,11 +225,34 @@ func Prepare(cfg PrepareConfig, dir string, uuid *types.UUID) error {
 		log.SetOutput(os.Stderr)
 	}
 
+	if err := validateAppImages(cfg.Apps, cfg.Images); err != nil {
+		return err
+	}
+
+	log.Printf("Verifying image labels and signatures")
+	if err := verifyImages(cfg.CommonConfig); err != nil {
+		return err
+	}
+
+	if cfg.UseOverlay && cfg.PrivateUsers.Enabled() {
+		return fmt.Errorf("overlay filesystem combined with user namespaces (--private-users) is not implemented")
+	}
+
+	if cfg.Interactive && len(cfg.Apps) != 1 {
+		return ErrInteractiveMultiApp
+	}
+
 	log.Printf("Preparing stage1")
-	if err := prepareStage1Image(cfg, cfg.Stage1Image, dir, cfg.UseOverlay); err != nil {
+	stage1Deps, err := prepareStage1Image(cfg, cfg.Stage1Image, dir, cfg.UseOverlay)
+	if err != nil {
 		return fmt.Errorf("error preparing stage1: %v", err)
 	}
 
+	usedKeys := map[string]bool{cfg.Stage1Image.String(): true}
+	for _, dep := range stage1Deps {
+		usedKeys[dep] = true
+	}
+
 	cm := schema.PodManifest{
 		ACKind: "PodManifest",
 		Apps:   make(schema.AppList, 0),
@@ -124,11 +264,20 @@ func Prepare(cfg PrepareConfig, dir string, uuid *types.UUID) error {
 	}
 	cm.ACVersion = *v
 
-	for i, img := range cfg.Images {
-		am, err := prepareAppImage(cfg, img, dir, cfg.UseOverlay)
+	for _, appCfg := range cfg.Apps {
+		img := appCfg.ImageHash
+		am, deps, err := prepareAppImage(cfg, img, dir, cfg.UseOverlay)
 		if err != nil {
 			return fmt.Errorf("error setting up image %s: %v", img, err)
 		}
+		// An app rendered with a PerAppFileMap lives under the salted key
+		// TreeStoreKey returns for it, not the plain image key; usedKeys
+		// must track that same salted key or GC deletes the render this
+		// Prepare call just created.
+		usedKeys[cas.TreeStoreKey(img.String(), cfg.PerAppFileMap[img])] = true
+		for _, dep := range deps {
+			usedKeys[dep] = true
+		}
 		if cm.Apps.Get(am.Name) != nil {
 			return fmt.Errorf("error: multiple apps with name %s", am.Name)
 		}
@@ -142,19 +291,30 @@ func Prepare(cfg PrepareConfig, dir string, uuid *types.UUID) error {
 				Name: &am.Name,
 				ID:   img,
 			},
-			Annotations: am.Annotations,
+			Annotations:    am.Annotations,
+			Mounts:         appCfg.MountOverrides,
+			ReadOnlyRootFS: appCfg.ReadOnlyRootfs,
 		}
 
-		if len(cfg.ExecAppends[i]) > 0 {
-			a.App = am.App
-			a.App.Exec = append(a.App.Exec, cfg.ExecAppends[i]...)
-		}
+		needsAppOverride := len(appCfg.ExecAppend) > 0 || len(appCfg.Env) > 0 ||
+			appCfg.User != "" || appCfg.Group != "" || appCfg.WorkingDir != "" ||
+			cfg.InheritEnv || len(cfg.ExplicitEnv) > 0
 
-		if cfg.InheritEnv || len(cfg.ExplicitEnv) > 0 {
-			if a.App == nil {
-				a.App = am.App
+		if needsAppOverride {
+			a.App = am.App
+			if len(appCfg.ExecAppend) > 0 {
+				a.App.Exec = append(a.App.Exec, appCfg.ExecAppend...)
+			}
+			if appCfg.User != "" {
+				a.App.User = appCfg.User
+			}
+			if appCfg.Group != "" {
+				a.App.Group = appCfg.Group
 			}
-			MergeEnvs(&a.App.Environment, cfg.InheritEnv, cfg.ExplicitEnv)
+			if appCfg.WorkingDir != "" {
+				a.App.WorkingDirectory = appCfg.WorkingDir
+			}
+			MergeEnvs(&a.App.Environment, cfg.InheritEnv, append(cfg.ExplicitEnv, appCfg.Env...))
 		}
 		cm.Apps = append(cm.Apps, a)
 	}
@@ -188,6 +348,14 @@ func Prepare(cfg PrepareConfig, dir string, uuid *types.UUID) error {
 		defer f.Close()
 	}
 
+	keys := make([]string, 0, len(usedKeys))
+	for k := range usedKeys {
+		keys = append(keys, k)
+	}
+	if err := cfg.Store.GC(keys); err != nil {
+		log.Printf("Warning: error garbage collecting tree store: %v", err)
+	}
+
 	return nil
 }
 
@@ -247,6 +415,11 @@ func Run(cfg RunConfig, dir string) {
 		}
 	}
 
+	log.Printf("Setting up journal access")
+	if err := setupJournalACL(cfg, dir); err != nil {
+		log.Fatalf("error setting up journal ACL: %v", err)
+	}
+
 	if err := os.Setenv(common.EnvLockFd, fmt.Sprintf("%v", cfg.LockFd)); err != nil {
 		log.Fatalf("setting lock fd environment: %v", err)
 	}
@@ -279,6 +452,9 @@ func Run(cfg RunConfig, dir string) {
 	if cfg.Interactive {
 		args = append(args, "--interactive")
 	}
+	if cfg.PrivateUsers.Enabled() {
+		args = append(args, fmt.Sprintf("--private-users=%s", cfg.PrivateUsers))
+	}
 	args = append(args, cfg.UUID.String())
 
 	// make sure the lock fd stays open across exec
@@ -295,37 +471,56 @@ func Run(cfg RunConfig, dir string) {
 // corresponds to the given hash.
 // When useOverlay is false, it attempts to render and expand the app image
 // TODO(jonboulle): tighten up the Hash type here; currently it is partially-populated (i.e. half-length sha512)
-func prepareAppImage(cfg PrepareConfig, img types.Hash, cdir string, useOverlay bool) (*schema.ImageManifest, error) {
+func prepareAppImage(cfg PrepareConfig, img types.Hash, cdir string, useOverlay bool) (*schema.ImageManifest, []string, error) {
 	log.Println("Loading image", img.String())
 
-	if useOverlay {
-		if err := cfg.Store.RenderTreeStore(img.String(), false); err != nil {
-			return nil, fmt.Errorf("error rendering tree image: %v", err)
+	fileMap := cfg.PerAppFileMap[img]
+
+	if useOverlay || cfg.PrivateUsers.Enabled() {
+		if err := cfg.Store.RenderTreeStore(img.String(), false, false, fileMap); err != nil {
+			return nil, nil, fmt.Errorf("error rendering tree image: %v", err)
 		}
-		if err := cfg.Store.CheckTreeStore(img.String()); err != nil {
+		if err := cfg.Store.CheckTreeStore(img.String(), fileMap); err != nil {
 			log.Printf("Warning: tree cache is in a bad state. Rebuilding...")
-			if err := cfg.Store.RenderTreeStore(img.String(), true); err != nil {
-				return nil, fmt.Errorf("error rendering tree image: %v", err)
+			if err := cfg.Store.RenderTreeStore(img.String(), true, false, fileMap); err != nil {
+				return nil, nil, fmt.Errorf("error rendering tree image: %v", err)
 			}
 		}
-	} else {
-		ad := common.AppImagePath(cdir, img)
-		err := os.MkdirAll(ad, 0755)
-		if err != nil {
-			return nil, fmt.Errorf("error creating image directory: %v", err)
+	}
+
+	deps, err := CreateDepListFromImageID(cfg.Store, img)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving dependency graph: %v", err)
+	}
+
+	ad := common.AppImagePath(cdir, img)
+	if err := os.MkdirAll(ad, 0755); err != nil {
+		return nil, nil, fmt.Errorf("error creating image directory: %v", err)
+	}
+
+	switch {
+	case useOverlay:
+		if err := writeDepList(ad, deps); err != nil {
+			return nil, nil, fmt.Errorf("error writing dependency list: %v", err)
 		}
 
-		if err := aci.RenderACIWithImageID(img, ad, cfg.Store); err != nil {
-			return nil, fmt.Errorf("error rendering ACI: %v", err)
+	case cfg.PrivateUsers.Enabled():
+		if err := renderShifted(cfg.Store, img, ad, cfg.PrivateUsers, fileMap); err != nil {
+			return nil, nil, fmt.Errorf("error rendering shifted image: %v", err)
+		}
+
+	default:
+		if err := aci.RenderACIWithImageID(img, ad, cfg.Store, fileMap); err != nil {
+			return nil, nil, fmt.Errorf("error rendering ACI: %v", err)
 		}
 	}
 
 	am, err := cfg.Store.GetImageManifest(img.String())
 	if err != nil {
-		return nil, fmt.Errorf("error getting the manifest: %v", err)
+		return nil, nil, fmt.Errorf("error getting the manifest: %v", err)
 	}
 
-	return am, nil
+	return am, deps, nil
 }
 
 // setupAppImage mounts the overlay filesystem for the app image that
@@ -339,44 +534,67 @@ func setupAppImage(cfg RunConfig, img types.Hash, cdir string, useOverlay bool)
 			return fmt.Errorf("error creating image directory: %v", err)
 		}
 
-		if err := overlayRender(cfg, img, cdir, ad); err != nil {
+		if err := overlayRender(cfg, img, cdir, ad, cfg.PerAppFileMap[img]); err != nil {
 			return fmt.Errorf("error rendering overlay filesystem: %v", err)
 		}
 	}
 
-	err := os.MkdirAll(filepath.Join(ad, "rootfs/tmp"), 0777)
-	if err != nil {
+	tmpDir := filepath.Join(ad, "rootfs/tmp")
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
 		return fmt.Errorf("error creating tmp directory: %v", err)
 	}
 
+	if cfg.PrivateUsers.Enabled() {
+		uid := int(cfg.PrivateUsers.Shift)
+		if err := os.Chown(tmpDir, uid, uid); err != nil {
+			return fmt.Errorf("error shifting tmp directory owner: %v", err)
+		}
+	}
+
 	return nil
 }
 
 // prepareStage1Image renders and verifies tree cache of the given hash
 // when using overlay.
 // When useOverlay is false, it attempts to render and expand the stage1.
-func prepareStage1Image(cfg PrepareConfig, img types.Hash, cdir string, useOverlay bool) error {
+func prepareStage1Image(cfg PrepareConfig, img types.Hash, cdir string, useOverlay bool) ([]string, error) {
 	s1 := common.Stage1ImagePath(cdir)
 	if err := os.MkdirAll(s1, 0755); err != nil {
-		return fmt.Errorf("error creating stage1 directory: %v", err)
+		return nil, fmt.Errorf("error creating stage1 directory: %v", err)
 	}
 
-	if err := cfg.Store.RenderTreeStore(img.String(), false); err != nil {
-		return fmt.Errorf("error rendering tree image: %v", err)
+	if err := cfg.Store.RenderTreeStore(img.String(), false, false, nil); err != nil {
+		return nil, fmt.Errorf("error rendering tree image: %v", err)
 	}
-	if err := cfg.Store.CheckTreeStore(img.String()); err != nil {
+	if err := cfg.Store.CheckTreeStore(img.String(), nil); err != nil {
 		log.Printf("Warning: tree cache is in a bad state. Rebuilding...")
-		if err := cfg.Store.RenderTreeStore(img.String(), true); err != nil {
-			return fmt.Errorf("error rendering tree image: %v", err)
+		if err := cfg.Store.RenderTreeStore(img.String(), true, false, nil); err != nil {
+			return nil, fmt.Errorf("error rendering tree image: %v", err)
 		}
 	}
 
-	if !useOverlay {
-		if err := aci.RenderACIWithImageID(img, s1, cfg.Store); err != nil {
-			return fmt.Errorf("error rendering ACI: %v", err)
+	deps, err := CreateDepListFromImageID(cfg.Store, img)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving dependency graph: %v", err)
+	}
+
+	switch {
+	case useOverlay:
+		if err := writeDepList(s1, deps); err != nil {
+			return nil, fmt.Errorf("error writing dependency list: %v", err)
+		}
+
+	case cfg.PrivateUsers.Enabled():
+		if err := renderShifted(cfg.Store, img, s1, cfg.PrivateUsers, nil); err != nil {
+			return nil, fmt.Errorf("error rendering shifted stage1: %v", err)
+		}
+
+	default:
+		if err := aci.RenderACIWithImageID(img, s1, cfg.Store, nil); err != nil {
+			return nil, fmt.Errorf("error rendering ACI: %v", err)
 		}
 	}
-	return nil
+	return deps, nil
 }
 
 // setupStage1Image mounts the overlay filesystem for stage1.
@@ -384,7 +602,7 @@ func prepareStage1Image(cfg PrepareConfig, img types.Hash, cdir string, useOverl
 func setupStage1Image(cfg RunConfig, img types.Hash, cdir string, useOverlay bool) error {
 	if useOverlay {
 		s1 := common.Stage1ImagePath(cdir)
-		if err := overlayRender(cfg, img, cdir, s1); err != nil {
+		if err := overlayRender(cfg, img, cdir, s1, nil); err != nil {
 			return fmt.Errorf("error rendering overlay filesystem: %v", err)
 		}
 	}
@@ -395,21 +613,19 @@ func setupStage1Image(cfg RunConfig, img types.Hash, cdir string, useOverlay boo
 // overlayRender renders the image that corresponds to the given hash using the
 // overlay filesystem.
 // It writes the manifest in the specified directory and mounts an overlay
-// filesystem from the cached tree of the image as rootfs.
-func overlayRender(cfg RunConfig, img types.Hash, cdir string, dest string) error {
+// filesystem from the cached tree of the image, stacked on top of a lowerdir
+// for every dependency recorded in dest's deps.list (most specific first,
+// ending at the base image), as rootfs. fileMap must match whatever was
+// passed to RenderTreeStore when the image was prepared, so the same
+// filtered (or full) tree store entry is found.
+func overlayRender(cfg RunConfig, img types.Hash, cdir string, dest string, fileMap map[string]struct{}) error {
 	manifest, err := cfg.Store.GetImageManifest(img.String())
 	if err != nil {
 		return err
 	}
 
-	mb, err := json.Marshal(manifest)
-	if err != nil {
-		return fmt.Errorf("error marshalling image manifest: %v", err)
-	}
-
-	log.Printf("Writing image manifest")
-	if err := ioutil.WriteFile(filepath.Join(dest, "manifest"), mb, 0700); err != nil {
-		return fmt.Errorf("error writing pod manifest: %v", err)
+	if err := writeManifest(manifest, dest); err != nil {
+		return err
 	}
 
 	destRootfs := path.Join(dest, "rootfs")
@@ -417,7 +633,15 @@ func overlayRender(cfg RunConfig, img types.Hash, cdir string, dest string) erro
 		return err
 	}
 
-	cachedTreePath := cfg.Store.GetTreeStoreRootFS(img.String())
+	deps, err := readDepList(dest)
+	if err != nil {
+		return err
+	}
+	lowerDirs := []string{cfg.Store.GetTreeStoreRootFS(img.String(), fileMap)}
+	for _, dep := range deps {
+		lowerDirs = append(lowerDirs, cfg.Store.GetTreeStoreRootFS(dep, nil))
+	}
+	cachedTreePath := strings.Join(lowerDirs, ":")
 
 	overlayDir := path.Join(cdir, "overlay", img.String())
 	if err := os.MkdirAll(overlayDir, 0755); err != nil {
@@ -0,0 +1,154 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build linux
+
+package stage0
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema"
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+	"github.com/coreos/rkt/cas"
+)
+
+// renderShifted lays out an already-rendered treestore image at dest for
+// the private-users case: it writes the manifest alongside a copy of the
+// treestore's rootfs with every file's ownership shifted by pu. It can't
+// just render (or hardlink) the treestore directly in place like the
+// overlay path does, because the copy is what's going to be owned by the
+// shifted range -- the shared treestore cache itself must stay owned by
+// the invoking user. fileMap must match whatever was passed to
+// RenderTreeStore for img, so the same (possibly filtered) tree store
+// entry is found.
+func renderShifted(store *cas.Store, img types.Hash, dest string, pu PrivateUsers, fileMap map[string]struct{}) error {
+	im, err := store.GetImageManifest(img.String())
+	if err != nil {
+		return fmt.Errorf("error getting manifest: %v", err)
+	}
+	if err := writeManifest(im, dest); err != nil {
+		return err
+	}
+
+	return CopyTree(store.GetTreeStoreRootFS(img.String(), fileMap), filepath.Join(dest, "rootfs"), pu)
+}
+
+// writeManifest marshals im and writes it to dest/manifest, as expected
+// alongside a rendered or copied rootfs/.
+func writeManifest(im *schema.ImageManifest, dest string) error {
+	mb, err := json.Marshal(im)
+	if err != nil {
+		return fmt.Errorf("error marshalling image manifest: %v", err)
+	}
+
+	log.Printf("Writing image manifest")
+	if err := ioutil.WriteFile(filepath.Join(dest, "manifest"), mb, 0700); err != nil {
+		return fmt.Errorf("error writing image manifest: %v", err)
+	}
+	return nil
+}
+
+// CopyTree recursively copies src to dst, preserving directory structure,
+// symlinks and file modes, and -- when pu is enabled -- shifting every
+// copied entry's owning uid/gid by pu.Shift. It's the non-overlay
+// counterpart to a plain overlay lowerdir mount: the private-users case
+// needs an owned copy of the image rather than a shared, read-only tree.
+func CopyTree(src, dst string, pu PrivateUsers) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := dst
+		if rel != "." {
+			target = filepath.Join(dst, rel)
+		}
+
+		uid, gid, err := shiftedOwner(info, pu)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode()); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(linkTarget, target); err != nil {
+				return err
+			}
+		default:
+			if err := copyFile(p, target, info.Mode()); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+		// The umask trims the mode given at creation and chown clears
+		// setuid/setgid, so set the source mode again last.
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(target, info.Mode())
+	})
+}
+
+func shiftedOwner(info os.FileInfo, pu PrivateUsers) (uid, gid int, err error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("cannot determine owner of %q", info.Name())
+	}
+	uid, gid = int(st.Uid), int(st.Gid)
+	if pu.Enabled() {
+		uid += int(pu.Shift)
+		gid += int(pu.Shift)
+	}
+	return uid, gid, nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	_, err = io.Copy(d, s)
+	return err
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//+build linux
+
+package stage0
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema/types"
+)
+
+// verifyImages validates every image cfg.Images will run, and everything
+// they transitively depend on: their os/arch labels must suit this host
+// (or be waived by cfg.AllowAnyArch), and, unless cfg.InsecureSkipVerify is
+// set or cfg.TrustedKeystore is nil, each blob must carry a signature from a key
+// the keystore trusts. All failures are collected so a misconfigured pod
+// reports everything wrong with it at once, not just the first problem hit.
+func verifyImages(cfg CommonConfig) error {
+	roots := append([]types.Hash{cfg.Stage1Image}, cfg.Images...)
+
+	keys := map[string]bool{}
+	for _, img := range roots {
+		keys[img.String()] = true
+	}
+	for _, img := range roots {
+		deps, err := cfg.Store.Dependencies(img.String())
+		if err != nil {
+			return fmt.Errorf("error resolving dependencies of %s: %v", img, err)
+		}
+		for _, d := range deps {
+			keys[d] = true
+		}
+	}
+
+	var errs []string
+	for key := range keys {
+		if err := verifyImage(cfg, key); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("image verification failed:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+func verifyImage(cfg CommonConfig, key string) error {
+	im, err := cfg.Store.GetImageManifest(key)
+	if err != nil {
+		return fmt.Errorf("error getting manifest: %v", err)
+	}
+
+	if err := validateOSArch(im.Labels, cfg.AllowAnyArch); err != nil {
+		return err
+	}
+
+	return verifyImageSignature(cfg, key)
+}
+
+// validateOSArch checks an image's "os" and "arch" labels, defaulting
+// unset ones to "linux" and the host's own GOARCH, against
+// types.ValidOSArch. Unless allowAnyArch is set (the --allow-any-arch CI
+// escape hatch), the labels must also match the host's actual os/arch,
+// since an image that merely names a valid combination could still be
+// unexecutable here.
+func validateOSArch(labels types.Labels, allowAnyArch bool) error {
+	osLabel := "linux"
+	if v, ok := labels.Get("os"); ok {
+		osLabel = v
+	}
+	archLabel := runtime.GOARCH
+	if v, ok := labels.Get("arch"); ok {
+		archLabel = v
+	}
+
+	archs, ok := types.ValidOSArch[osLabel]
+	if !ok {
+		return fmt.Errorf("invalid os label %q", osLabel)
+	}
+	if !archs[archLabel] {
+		return fmt.Errorf("invalid arch label %q for os %q", archLabel, osLabel)
+	}
+
+	if allowAnyArch {
+		return nil
+	}
+	if osLabel != runtime.GOOS {
+		return fmt.Errorf("image os %q does not match host os %q", osLabel, runtime.GOOS)
+	}
+	if archLabel != runtime.GOARCH {
+		return fmt.Errorf("image arch %q does not match host arch %q", archLabel, runtime.GOARCH)
+	}
+	return nil
+}
+
+// verifyImageSignature checks the ACI blob for key against the detached
+// signature recorded on its Remote (if it was fetched from one) using
+// cfg.TrustedKeystore. A nil keystore, or cfg.InsecureSkipVerify, both
+// disable verification entirely, for offline or CI use.
+func verifyImageSignature(cfg CommonConfig, key string) error {
+	if cfg.InsecureSkipVerify || cfg.TrustedKeystore == nil {
+		return nil
+	}
+
+	remote, found, err := cfg.Store.GetRemoteByBlobKey(key)
+	if err != nil {
+		return fmt.Errorf("error looking up remote: %v", err)
+	}
+	if !found || len(remote.Signature) == 0 {
+		return fmt.Errorf("image is unsigned")
+	}
+
+	// The signature is computed over the as-fetched bytes, which are
+	// typically still gzip-compressed -- not ReadStream's normalized,
+	// decompressed copy -- so verify against ReadRawStream instead.
+	aciFile, err := cfg.Store.ReadRawStream(key)
+	if err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+	defer aciFile.Close()
+
+	if _, err := cfg.TrustedKeystore.CheckSignature(key, aciFile, bytes.NewReader(remote.Signature)); err != nil {
+		return fmt.Errorf("untrusted signature: %v", err)
+	}
+	return nil
+}